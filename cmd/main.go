@@ -1,16 +1,42 @@
 package main
 
 import (
+    "context"
+    "crypto/subtle"
     "encoding/json"
+    "errors"
     "flag"
     "fmt"
     "log"
+    "log/slog"
     "net/http"
     "os"
+    "os/signal"
     "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
 
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/bootstrap"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/certs"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/clients"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/config"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/dnsserver"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/docker"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/externaldns"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/gitops"
     "github.com/jlengelbrecht/unifi-dns-sync/internal/handlers"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/health"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/logging"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/metrics"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/rfc2136"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/sso"
     "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/syncer"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/verify"
 )
 
 var (
@@ -19,26 +45,67 @@ var (
 )
 
 func main() {
-    var (
-        port       = flag.Int("port", 52638, "Port to run the server on")
-        dataDir    = flag.String("data-dir", "data", "Directory for data storage")
-        debug      = flag.Bool("debug", false, "Enable debug logging")
-    )
-    flag.Parse()
-
-    // Configure logging
-    if *debug {
-        log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Llongfile)
-    } else {
-        log.SetFlags(log.Ldate | log.Ltime)
+    args := os.Args[1:]
+    if len(args) > 0 && args[0] == "config" {
+        os.Exit(configCommand(args[1:]))
+    }
+
+    if err := run(args); err != nil {
+        slog.Error("Exiting", "error", err)
+        os.Exit(1)
+    }
+}
+
+// run starts the server and blocks until it is shut down. Everything it
+// starts is stopped again by deferred cleanup, also when startup fails
+// part way, and the database is closed last.
+func run(args []string) error {
+    cfg, err := config.Load(flag.CommandLine, args)
+    if err != nil {
+        return fmt.Errorf("configuration: %w", err)
+    }
+
+    // Configure logging; -debug is short for -log-level debug with source
+    // locations
+    level := cfg.Log.Level
+    if cfg.Debug {
+        level = "debug"
+    }
+    if err := logging.Setup(os.Stderr, level, cfg.Log.Format, cfg.Debug); err != nil {
+        return fmt.Errorf("configuration: %w", err)
     }
 
     log.Printf("Starting Unifi DNS Manager %s (%s)", Version, Commit)
 
+    // Shut down on SIGINT or SIGTERM; a listener that fails stops the
+    // process the same way and its error is returned
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    failure := make(chan error, 1)
+    fail := func(format string, args ...interface{}) {
+        select {
+        case failure <- fmt.Errorf(format, args...):
+        default:
+        }
+        stop()
+    }
+
+    // Background jobs run until ctx is cancelled, and shutdown waits for
+    // them; shutdowns stop the listeners
+    var jobs sync.WaitGroup
+    goJob := func(run func()) {
+        jobs.Add(1)
+        go func() {
+            defer jobs.Done()
+            run()
+        }()
+    }
+    var shutdowns []func(context.Context) error
+
     // Create mux for better route handling
     mux := http.NewServeMux()
 
-    // Health check endpoint (no middleware)
+    // Health check endpoint (no middleware); see also /healthz and /readyz
     mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Content-Type", "application/json")
         w.WriteHeader(http.StatusOK)
@@ -50,69 +117,665 @@ func main() {
     })
 
     // Ensure data directory exists with correct permissions
-    dataPath := filepath.Join(*dataDir)
+    dataPath := filepath.Join(cfg.DataDir)
     if err := os.MkdirAll(dataPath, 0777); err != nil {
-        log.Fatalf("Failed to create data directory: %v", err)
+        return fmt.Errorf("failed to create data directory: %w", err)
     }
 
     // Initialize database
     dbPath := filepath.Join(dataPath, "unifi-dns.db")
     store, err := store.NewStore(dbPath)
     if err != nil {
-        log.Fatalf("Failed to initialize database: %v", err)
+        return fmt.Errorf("failed to initialize database: %w", err)
     }
-    defer store.Close()
+    defer func() {
+        if err := store.Close(); err != nil {
+            log.Printf("Shutdown: closing database: %v", err)
+        }
+        log.Printf("Stopped")
+    }()
+
+    // Set up unattended installs from the environment or a bootstrap file
+    boot, err := bootstrap.Load(cfg.BootstrapFile)
+    if err != nil {
+        return fmt.Errorf("failed to load bootstrap settings: %w", err)
+    }
+    if !boot.Empty() {
+        if _, err := bootstrap.Apply(store, boot); err != nil {
+            return fmt.Errorf("failed to bootstrap: %w", err)
+        }
+    }
+
+    // Keep the UniFi devices in line with the stored records
+    recordSyncer := syncer.New(store)
+
+    // Shut down in order before the database closes: stop the listeners
+    // first, so handlers in progress can still use the store and the
+    // syncer, then let a sync in progress finish its controller writes and
+    // wait for the background jobs to see the cancelled context. The jobs
+    // are waited for even past the timeout, as they still use the store.
+    defer func() {
+        stop()
+        log.Printf("Shutting down (waiting up to %s)", cfg.ShutdownTimeout)
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+        defer cancel()
+
+        for _, shutdown := range shutdowns {
+            if err := shutdown(shutdownCtx); err != nil {
+                log.Printf("Shutdown: %v", err)
+            }
+        }
+
+        drained := make(chan struct{})
+        go func() {
+            recordSyncer.Close()
+            jobs.Wait()
+            close(drained)
+        }()
+        select {
+        case <-drained:
+        case <-shutdownCtx.Done():
+            slog.Warn("Shutdown timed out with background jobs still running; waiting for them before closing the database")
+            <-drained
+        }
+    }()
+    goJob(func() { recordSyncer.Run(ctx, cfg.SyncInterval) })
+
+    // Probes: liveness fails when the sync loop is stuck, which a restart
+    // can fix; readiness also needs a current database and fails once
+    // shutdown starts
+    syncStall := 2*cfg.SyncInterval + 5*time.Minute
+    liveness := health.New(5 * time.Second)
+    liveness.Add("scheduler", health.Heartbeat(recordSyncer.Heartbeat, syncStall))
+    readiness := health.New(5 * time.Second)
+    readiness.Add("database", health.Database(store))
+    readiness.Add("schema", health.Schema(store))
+    readiness.Add("scheduler", health.Heartbeat(recordSyncer.Heartbeat, syncStall))
+    readiness.Add("shutdown", func(context.Context) error {
+        if ctx.Err() != nil {
+            return errors.New("shutting down")
+        }
+        return nil
+    })
+    readiness.Controllers = health.Controllers(store)
+    mux.Handle("/healthz", liveness.Handler())
+
+    // Periodically check that the gateways answer with the stored records
+    verifier := verify.New(store, 5*time.Second)
+    if cfg.Verify.Interval > 0 {
+        goJob(func() { verifier.Run(ctx, cfg.Verify.Interval) })
+    }
+
+    // Publish UniFi client aliases for devices that enable it
+    importer := clients.NewImporter(store, recordSyncer, cfg.Clients.Interval)
+    goJob(func() { importer.Run(ctx) })
+
+    // Start the GitOps watcher if a records directory is configured
+    if cfg.GitOps.Dir != "" {
+        watcher := gitops.NewWatcher(store, recordSyncer, cfg.GitOps.Dir, cfg.GitOps.Interval)
+        goJob(func() { watcher.Run(ctx) })
+    }
+
+    // Publish records for labelled Docker containers
+    if cfg.Docker.Socket != "" {
+        discovery := docker.NewDiscovery(store, recordSyncer, docker.NewClient(cfg.Docker.Socket), cfg.Docker.Interval)
+        goJob(func() { discovery.Run(ctx) })
+    }
+
+    // Accept RFC 2136 dynamic updates
+    if cfg.RFC2136.Listen != "" {
+        zones, err := rfc2136.ParseZones(cfg.RFC2136.Zones)
+        if err != nil {
+            return fmt.Errorf("invalid -rfc2136-zones: %w", err)
+        }
+        keys, err := rfc2136.ParseKeys(cfg.RFC2136.TSIGKeys)
+        if err != nil {
+            return fmt.Errorf("invalid -rfc2136-tsig-keys: %w", err)
+        }
+        if len(keys) == 0 {
+            return errors.New("invalid -rfc2136-tsig-keys: at least one key is required")
+        }
+
+        updates := rfc2136.NewServer(store, recordSyncer, zones, keys)
+        shutdowns = append(shutdowns, updates.Shutdown)
+        go func() {
+            log.Printf("Starting RFC 2136 update listener on %s", cfg.RFC2136.Listen)
+            if err := updates.ListenAndServe(cfg.RFC2136.Listen); err != nil && ctx.Err() == nil {
+                fail("RFC 2136 update listener failed: %v", err)
+            }
+        }()
+    }
+
+    // Serve the desired records over DNS
+    if cfg.DNS.Listen != "" {
+        server := dnsserver.NewServer(store, cfg.DNS.Device, cfg.DNS.TTL)
+        shutdowns = append(shutdowns, server.Shutdown)
+        goJob(func() { server.Run(ctx, cfg.DNS.ReloadInterval) })
+        go func() {
+            log.Printf("Starting DNS server on %s", cfg.DNS.Listen)
+            if err := server.ListenAndServe(cfg.DNS.Listen); err != nil && ctx.Err() == nil {
+                fail("DNS server failed: %v", err)
+            }
+        }()
+    }
+
+    // Serve the external-dns webhook provider on its own listener
+    if cfg.ExternalDNS.Listen != "" {
+        provider := externaldns.NewProvider(store, recordSyncer)
+        provider.RequireToken(cfg.ExternalDNS.Token)
+        server := &http.Server{Addr: cfg.ExternalDNS.Listen, Handler: handlers.RequestIDMiddleware(provider.Handler())}
+        shutdowns = append(shutdowns, server.Shutdown)
+        go func() {
+            log.Printf("Starting external-dns webhook provider on %s", cfg.ExternalDNS.Listen)
+            if err := server.ListenAndServe(); err != http.ErrServerClosed {
+                fail("external-dns webhook provider failed: %v", err)
+            }
+        }()
+    }
+
+    // Configure single sign-on
+    var provider *sso.Provider
+    if cfg.OIDC.Issuer != "" {
+        roleMap, err := sso.ParseRoleMap(cfg.OIDC.RoleMap)
+        if err != nil {
+            return fmt.Errorf("invalid -oidc-role-map: %w", err)
+        }
+
+        provider, err = sso.New(ctx, sso.Config{
+            Issuer:       cfg.OIDC.Issuer,
+            ClientID:     cfg.OIDC.ClientID,
+            ClientSecret: cfg.OIDC.ClientSecret,
+            RedirectURL:  cfg.OIDC.RedirectURL,
+            GroupsClaim:  cfg.OIDC.GroupsClaim,
+            RoleMap:      roleMap,
+            DefaultRole:  cfg.OIDC.DefaultRole,
+        })
+        if err != nil {
+            return fmt.Errorf("failed to configure OpenID Connect: %w", err)
+        }
+        log.Printf("Single sign-on enabled with %s", cfg.OIDC.Issuer)
+    }
+
+    // Keep sessions in the database and remove them once they expire
+    sessions := handlers.NewSessionManager(store, cfg.Session.IdleTimeout, cfg.Session.MaxAge)
+    goJob(func() { sessions.Run(ctx, 10*time.Minute) })
 
     // Initialize handler
-    h, err := handlers.NewHandler("web/templates", store)
+    h, err := handlers.NewHandler("web/templates", store, sessions, recordSyncer, verifier, provider)
+    if err != nil {
+        return fmt.Errorf("failed to initialize handler: %w", err)
+    }
+
+    // Until an admin exists, the setup page requires a token from the log
+    // or the environment, so whoever reaches the port first cannot take over
+    appConfig, err := store.GetAppConfig()
     if err != nil {
-        log.Fatalf("Failed to initialize handler: %v", err)
+        return fmt.Errorf("failed to load app config: %w", err)
+    }
+    if !appConfig.IsInitialized {
+        token, generated, err := bootstrap.SetupToken()
+        if err != nil {
+            return fmt.Errorf("failed to get setup token: %w", err)
+        }
+        h.RequireSetupToken(token)
+        if generated {
+            log.Printf("Setup token: %s (open /setup?token=%s to create the first admin)", token, token)
+        } else {
+            log.Printf("Setup requires the token from UDS_SETUP_TOKEN")
+        }
+    }
+
+    // Expose Prometheus metrics, which need a token unless explicitly public
+    if cfg.Metrics.Enabled && cfg.Metrics.Token == "" && !cfg.Metrics.Public {
+        slog.Warn("Not serving /metrics: set -metrics-token, or -metrics-public to serve them without one")
+    } else if cfg.Metrics.Enabled {
+        metrics.NewGauge("unifi_dns_build_info", "Version and commit of the running server.", "version", "commit").
+            Set(1, Version, Commit)
+        metrics.NewGaugeFunc("unifi_dns_records", "Stored records by device, type and whether they are enabled.",
+            func(emit func(float64, ...string)) {
+                counts, err := store.CountDNSRecords()
+                if err != nil {
+                    log.Printf("Metrics: failed to count records: %v", err)
+                    return
+                }
+                for _, count := range counts {
+                    emit(float64(count.Count), count.Device, count.RRType, strconv.FormatBool(count.Enabled))
+                }
+            }, "device", "type", "enabled")
+
+        metricsHandler := metrics.Handler()
+        mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+            if cfg.Metrics.Token != "" && !hasBearer(r, cfg.Metrics.Token) {
+                w.Header().Set("WWW-Authenticate", "Bearer")
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+            }
+            metricsHandler.ServeHTTP(w, r)
+        })
+    }
+
+    // Readiness is public for probes, but the controller report it adds
+    // for ?devices=1 names the devices and dials each controller, so it
+    // needs the metrics token or a viewer
+    readyz := readiness.Handler().ServeHTTP
+    viewerReadyz := h.RequireRole(models.RoleViewer)(readyz)
+    mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Query().Get("devices") == "" ||
+            (cfg.Metrics.Token != "" && hasBearer(r, cfg.Metrics.Token)) {
+            readyz(w, r)
+            return
+        }
+        viewerReadyz(w, r)
+    })
+
+    // Only listed origins may call the API cross-origin
+    var origins []string
+    for _, origin := range strings.Split(cfg.CORSOrigins, ",") {
+        if origin = strings.TrimSpace(origin); origin != "" {
+            origins = append(origins, origin)
+        }
     }
+    corsMiddleware := handlers.NewCORSMiddleware(origins)
 
     // Set up routes with middleware
     mux.HandleFunc("/", handlers.Chain(h.Index,
+        handlers.CSRFMiddleware,
         handlers.LoggingMiddleware,
         handlers.RecoveryMiddleware,
     ))
     
     mux.HandleFunc("/setup", handlers.Chain(h.Setup,
+        handlers.CSRFMiddleware,
         handlers.LoggingMiddleware,
         handlers.RecoveryMiddleware,
     ))
     
     mux.HandleFunc("/login", handlers.Chain(h.Login,
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+    ))
+    
+    mux.HandleFunc("/login/2fa", handlers.Chain(h.LoginSecondFactor,
+        handlers.CSRFMiddleware,
         handlers.LoggingMiddleware,
         handlers.RecoveryMiddleware,
     ))
     
     mux.HandleFunc("/logout", handlers.Chain(h.Logout,
+        handlers.CSRFMiddleware,
         handlers.LoggingMiddleware,
         handlers.RecoveryMiddleware,
     ))
     
+    mux.HandleFunc("/auth/oidc/login", handlers.Chain(h.OIDCLogin,
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+    ))
+
+    mux.HandleFunc("/auth/oidc/callback", handlers.Chain(h.OIDCCallback,
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+    ))
+
     mux.HandleFunc("/onboarding", handlers.Chain(h.Onboarding,
+        handlers.CSRFMiddleware,
         handlers.LoggingMiddleware,
         handlers.RecoveryMiddleware,
     ))
     
     mux.HandleFunc("/api/devices", handlers.Chain(h.GetDevices,
+        h.RequireRole(models.RoleViewer),
+        handlers.CSRFMiddleware,
         handlers.LoggingMiddleware,
         handlers.RecoveryMiddleware,
         handlers.JSONMiddleware,
-        handlers.CORSMiddleware,
+        corsMiddleware,
     ))
     
     mux.HandleFunc("/api/devices/add", handlers.Chain(h.AddDevice,
+        h.RequireRole(models.RoleAdmin),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/devices/tls", handlers.Chain(h.DeviceTLS,
+        h.RequireRole(models.RoleAdmin),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/devices/tls/repin", handlers.Chain(h.RepinDevice,
+        h.RequireRole(models.RoleAdmin),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/dns", handlers.Chain(h.DNSRecords,
+        h.RequireRole(models.RoleViewer),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/dns/create", handlers.Chain(h.CreateDNSRecord,
+        h.RequireRole(models.RoleOperator),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/dns/update", handlers.Chain(h.UpdateDNSRecord,
+        h.RequireRole(models.RoleOperator),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/dns/verify", handlers.Chain(h.VerifyDNSRecords,
+        h.RequireRole(models.RoleOperator),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/dns/ptr-conflicts", handlers.Chain(h.PTRConflicts,
+        h.RequireRole(models.RoleViewer),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/grants", handlers.Chain(h.Grants,
+        h.RequireRole(models.RoleAdmin),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/users", handlers.Chain(h.UsersPage,
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+    ))
+
+    mux.HandleFunc("/api/users", handlers.Chain(h.Users,
+        h.RequireRole(models.RoleAdmin),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/users/create", handlers.Chain(h.CreateUser,
+        h.RequireRole(models.RoleAdmin),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/users/update", handlers.Chain(h.UpdateUser,
+        h.RequireRole(models.RoleAdmin),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/users/reset-password", handlers.Chain(h.ResetPassword,
+        h.RequireRole(models.RoleAdmin),
+        handlers.CSRFMiddleware,
         handlers.LoggingMiddleware,
         handlers.RecoveryMiddleware,
         handlers.JSONMiddleware,
-        handlers.CORSMiddleware,
+        corsMiddleware,
     ))
 
+    mux.HandleFunc("/api/account/password", handlers.Chain(h.ChangePassword,
+        h.RequireRole(models.RoleViewer),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/tokens", handlers.Chain(h.APITokens,
+        h.RequireRole(models.RoleViewer),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/tokens/create", handlers.Chain(h.CreateAPIToken,
+        h.RequireRole(models.RoleViewer),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/users/reset-2fa", handlers.Chain(h.ResetTwoFactor,
+        h.RequireRole(models.RoleAdmin),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/account/2fa", handlers.Chain(h.TwoFactorStatus,
+        h.RequireRole(models.RoleViewer),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/account/2fa/setup", handlers.Chain(h.TwoFactorSetup,
+        h.RequireRole(models.RoleViewer),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/account/2fa/enable", handlers.Chain(h.TwoFactorEnable,
+        h.RequireRole(models.RoleViewer),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/account/2fa/disable", handlers.Chain(h.TwoFactorDisable,
+        h.RequireRole(models.RoleViewer),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/account/2fa/recovery-codes", handlers.Chain(h.TwoFactorRecoveryCodes,
+        h.RequireRole(models.RoleViewer),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/sessions", handlers.Chain(h.Sessions,
+        h.RequireRole(models.RoleViewer),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/sessions/logout-all", handlers.Chain(h.LogoutAllSessions,
+        h.RequireRole(models.RoleViewer),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/users/unlock", handlers.Chain(h.UnlockUser,
+        h.RequireRole(models.RoleAdmin),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    mux.HandleFunc("/api/audit", handlers.Chain(h.AuditLog,
+        h.RequireRole(models.RoleAdmin),
+        handlers.CSRFMiddleware,
+        handlers.LoggingMiddleware,
+        handlers.RecoveryMiddleware,
+        handlers.JSONMiddleware,
+        corsMiddleware,
+    ))
+
+    // The versioned API serves the same handlers with JSON errors, method
+    // routing and an OpenAPI document
+    h.RegisterAPIv1(mux, Version, corsMiddleware)
+
     // Start server
-    addr := fmt.Sprintf("0.0.0.0:%d", *port)
-    log.Printf("Starting server on %s", addr)
-    if err := http.ListenAndServe(addr, mux); err != nil {
-        log.Fatalf("Server failed: %v", err)
+    server := &http.Server{
+        Addr:    fmt.Sprintf("0.0.0.0:%d", cfg.Port),
+        Handler: handlers.RequestIDMiddleware(mux),
+    }
+    // Stop accepting requests before anything else, so handlers in progress
+    // can still use the store and the syncer
+    shutdowns = append([]func(context.Context) error{server.Shutdown}, shutdowns...)
+
+    if cfg.TLS.Enabled() {
+        certFile, keyFile := cfg.TLS.CertFile, cfg.TLS.KeyFile
+        if cfg.TLS.SelfSigned {
+            certFile, keyFile, err = certs.SelfSigned(filepath.Join(dataPath, "tls"), splitHosts(cfg.TLS.Hosts))
+            if err != nil {
+                return fmt.Errorf("failed to create self-signed certificate: %w", err)
+            }
+        }
+        certificate, err := certs.NewLoader(certFile, keyFile)
+        if err != nil {
+            return fmt.Errorf("failed to load TLS certificate: %w", err)
+        }
+        goJob(func() { certificate.Watch(ctx, cfg.TLS.ReloadInterval) })
+        server.TLSConfig = certificate.TLSConfig()
+
+        // Redirect plain HTTP to HTTPS
+        if cfg.TLS.RedirectListen != "" {
+            redirect := &http.Server{Addr: cfg.TLS.RedirectListen, Handler: certs.RedirectHandler(cfg.Port)}
+            shutdowns = append(shutdowns, redirect.Shutdown)
+            go func() {
+                log.Printf("Redirecting HTTP on %s to HTTPS", cfg.TLS.RedirectListen)
+                if err := redirect.ListenAndServe(); err != http.ErrServerClosed {
+                    fail("HTTP redirect listener failed: %v", err)
+                }
+            }()
+        }
+    } else {
+        slog.Warn("Serving plain HTTP; browsers only send the session cookie over HTTPS, so sign-in needs a TLS proxy in front or -tls-self-signed / -tls-cert")
+    }
+
+    go func() {
+        var err error
+        if server.TLSConfig != nil {
+            log.Printf("Starting HTTPS server on %s", server.Addr)
+            err = server.ListenAndServeTLS("", "")
+        } else {
+            log.Printf("Starting server on %s", server.Addr)
+            err = server.ListenAndServe()
+        }
+        if err != http.ErrServerClosed {
+            fail("server failed: %v", err)
+        }
+    }()
+
+    <-ctx.Done()
+    select {
+    case err := <-failure:
+        return err
+    default:
+        return nil
+    }
+}
+
+// splitHosts parses the comma separated -tls-hosts list.
+func splitHosts(list string) []string {
+    var hosts []string
+    for _, host := range strings.Split(list, ",") {
+        if host = strings.TrimSpace(host); host != "" {
+            hosts = append(hosts, host)
+        }
+    }
+    return hosts
+}
+
+// hasBearer reports whether r carries token as its bearer token.
+func hasBearer(r *http.Request, token string) bool {
+    return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// configCommand runs "config print", which shows the effective
+// configuration with secrets redacted.
+func configCommand(args []string) int {
+    if len(args) == 0 || args[0] != "print" {
+        fmt.Fprintln(os.Stderr, "usage: unifi-dns-manager config print [flags]")
+        return 2
+    }
+
+    cfg, err := config.Load(flag.NewFlagSet("config print", flag.ExitOnError), args[1:])
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+
+    out, err := cfg.Redacted()
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
     }
+    os.Stdout.Write(out)
+    return 0
 }
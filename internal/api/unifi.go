@@ -2,42 +2,221 @@ package api
 
 import (
     "bytes"
+    "context"
+    "crypto/sha256"
     "crypto/tls"
+    "crypto/x509"
     "encoding/json"
+    "errors"
     "fmt"
     "io"
+    "net"
     "net/http"
     "net/http/cookiejar"
+    "strconv"
+    "strings"
+    "sync"
     "time"
 
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/logging"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/metrics"
     "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
 )
 
+var (
+    apiRequests = metrics.NewCounter("unifi_dns_unifi_api_requests_total",
+        "UniFi controller API calls by device, method, endpoint and status code (\"error\" when no response arrived).",
+        "device", "method", "endpoint", "code")
+    apiErrors = metrics.NewCounter("unifi_dns_unifi_api_errors_total",
+        "UniFi controller API calls that failed or returned an error status.", "device", "endpoint")
+    apiDuration = metrics.NewHistogram("unifi_dns_unifi_api_request_duration_seconds",
+        "UniFi controller API latency in seconds.", metrics.DefaultBuckets, "device", "endpoint")
+)
+
+// instrumentedTransport records metrics for every call to a controller.
+type instrumentedTransport struct {
+    next   http.RoundTripper
+    device string
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    start := time.Now()
+    resp, err := t.next.RoundTrip(req)
+    elapsed := time.Since(start)
+
+    ep := endpoint(req.URL.Path)
+    code := "error"
+    if err == nil {
+        code = strconv.Itoa(resp.StatusCode)
+    }
+    apiRequests.Inc(t.device, req.Method, ep, code)
+    apiDuration.Observe(elapsed.Seconds(), t.device, ep)
+    if err != nil || resp.StatusCode >= 400 {
+        apiErrors.Inc(t.device, ep)
+    }
+
+    logging.FromContext(req.Context()).Debug("UniFi API call", "device", t.device,
+        "method", req.Method, "endpoint", ep, "code", code, "duration", elapsed)
+    return resp, err
+}
+
+// endpoint names the API a path calls, without record IDs, such as
+// "rest/dnsrecord" or "auth/login".
+func endpoint(path string) string {
+    path = strings.TrimPrefix(path, "/proxy/network")
+    path = strings.TrimPrefix(path, "/api/")
+    path = strings.TrimPrefix(path, "s/default/")
+    if parts := strings.Split(path, "/"); len(parts) > 2 {
+        path = strings.Join(parts[:2], "/")
+    }
+    return path
+}
+
 type UnifiClient struct {
+    ctx     context.Context
     client  *http.Client
     baseURL string
     device  models.UnifiDevice
+
+    mu        sync.Mutex
+    presented string
+}
+
+// FingerprintMismatchError is returned when a controller with a pinned
+// certificate presents a different one.
+type FingerprintMismatchError struct {
+    Pinned    string
+    Presented string
 }
 
-func NewUnifiClient(device models.UnifiDevice) (*UnifiClient, error) {
+func (e *FingerprintMismatchError) Error() string {
+    return fmt.Sprintf("controller certificate changed: pinned %s, presented %s; re-pin the device if the change is expected",
+        e.Pinned, e.Presented)
+}
+
+// NewUnifiClient returns a client for the device's controller. Its
+// requests carry ctx, for cancellation and log fields.
+func NewUnifiClient(ctx context.Context, device models.UnifiDevice) (*UnifiClient, error) {
     jar, err := cookiejar.New(nil)
     if err != nil {
         return nil, err
     }
 
-    client := &http.Client{
+    c := &UnifiClient{
+        ctx:     ctx,
+        baseURL: fmt.Sprintf("https://%s", device.Address),
+        device:  device,
+    }
+
+    tlsConfig, err := c.tlsConfig()
+    if err != nil {
+        return nil, err
+    }
+
+    c.client = &http.Client{
         Timeout: time.Second * 10,
         Jar:     jar,
-        Transport: &http.Transport{
-            TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+        Transport: &instrumentedTransport{
+            next:   &http.Transport{TLSClientConfig: tlsConfig},
+            device: device.Name,
         },
     }
 
-    return &UnifiClient{
-        client:  client,
-        baseURL: fmt.Sprintf("https://%s", device.Address),
-        device:  device,
-    }, nil
+    return c, nil
+}
+
+// tlsConfig checks the controller's certificate as the device's TLSVerify
+// setting asks.
+func (c *UnifiClient) tlsConfig() (*tls.Config, error) {
+    switch c.device.TLSVerify {
+    case models.TLSVerifySystem:
+        return &tls.Config{}, nil
+
+    case models.TLSVerifyCA:
+        roots, err := ParseCABundle(c.device.TLSCA)
+        if err != nil {
+            return nil, err
+        }
+        return &tls.Config{RootCAs: roots}, nil
+
+    case models.TLSVerifyPin:
+        // The chain is not verified; the pin is checked instead, or
+        // recorded on first use.
+        return &tls.Config{
+            InsecureSkipVerify: true,
+            VerifyConnection: func(state tls.ConnectionState) error {
+                if len(state.PeerCertificates) == 0 {
+                    return errors.New("controller presented no certificate")
+                }
+                presented := Fingerprint(state.PeerCertificates[0].Raw)
+
+                c.mu.Lock()
+                c.presented = presented
+                c.mu.Unlock()
+
+                if pinned := c.device.TLSFingerprint; pinned != "" && pinned != presented {
+                    return &FingerprintMismatchError{Pinned: pinned, Presented: presented}
+                }
+                return nil
+            },
+        }, nil
+
+    default:
+        return nil, fmt.Errorf("unknown TLS verification mode %q", c.device.TLSVerify)
+    }
+}
+
+// PresentedFingerprint returns the fingerprint of the certificate the
+// controller presented, once connected to a device using TLSVerifyPin.
+func (c *UnifiClient) PresentedFingerprint() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.presented
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a DER encoded certificate
+// as colon separated hex, the form browsers show.
+func Fingerprint(der []byte) string {
+    sum := sha256.Sum256(der)
+    parts := make([]string, len(sum))
+    for i, b := range sum {
+        parts[i] = fmt.Sprintf("%02X", b)
+    }
+    return strings.Join(parts, ":")
+}
+
+// ParseCABundle returns the certificates in a PEM bundle.
+func ParseCABundle(bundle string) (*x509.CertPool, error) {
+    roots := x509.NewCertPool()
+    if !roots.AppendCertsFromPEM([]byte(bundle)) {
+        return nil, errors.New("CA bundle holds no PEM certificates")
+    }
+    return roots, nil
+}
+
+// FetchFingerprint connects to the controller at address without verifying
+// it and returns the fingerprint of the certificate it presents. It gives up
+// after 10 seconds or when ctx is done, whichever comes first.
+func FetchFingerprint(ctx context.Context, address string) (string, error) {
+    if _, _, err := net.SplitHostPort(address); err != nil {
+        address = net.JoinHostPort(strings.Trim(address, "[]"), "443")
+    }
+
+    dialer := &tls.Dialer{
+        NetDialer: &net.Dialer{Timeout: 10 * time.Second},
+        Config:    &tls.Config{InsecureSkipVerify: true},
+    }
+    conn, err := dialer.DialContext(ctx, "tcp", address)
+    if err != nil {
+        return "", err
+    }
+    defer conn.Close()
+
+    certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+    if len(certs) == 0 {
+        return "", errors.New("controller presented no certificate")
+    }
+    return Fingerprint(certs[0].Raw), nil
 }
 
 func (c *UnifiClient) Login() error {
@@ -51,7 +230,7 @@ func (c *UnifiClient) Login() error {
         return err
     }
 
-    resp, err := c.client.Post(c.baseURL+"/api/auth/login", "application/json", bytes.NewBuffer(jsonData))
+    resp, err := c.do("POST", "/api/auth/login", bytes.NewBuffer(jsonData))
     if err != nil {
         return err
     }
@@ -65,7 +244,7 @@ func (c *UnifiClient) Login() error {
 }
 
 func (c *UnifiClient) GetDNSRecords() ([]models.DNSRecord, error) {
-    resp, err := c.client.Get(c.baseURL + "/proxy/network/api/s/default/rest/dnsrecord")
+    resp, err := c.do("GET", "/proxy/network/api/s/default/rest/dnsrecord", nil)
     if err != nil {
         return nil, err
     }
@@ -97,11 +276,7 @@ func (c *UnifiClient) CreateDNSRecord(record models.DNSRecord) error {
         return err
     }
 
-    resp, err := c.client.Post(
-        c.baseURL+"/proxy/network/api/s/default/rest/dnsrecord",
-        "application/json",
-        bytes.NewBuffer(jsonData),
-    )
+    resp, err := c.do("POST", "/proxy/network/api/s/default/rest/dnsrecord", bytes.NewBuffer(jsonData))
     if err != nil {
         return err
     }
@@ -120,48 +295,103 @@ func (c *UnifiClient) UpdateDNSRecord(record models.DNSRecord) error {
         return err
     }
 
-    req, err := http.NewRequest(
-        "PUT",
-        fmt.Sprintf("%s/proxy/network/api/s/default/rest/dnsrecord/%s", c.baseURL, record.ID),
-        bytes.NewBuffer(jsonData),
-    )
+    resp, err := c.do("PUT", "/proxy/network/api/s/default/rest/dnsrecord/"+record.ID, bytes.NewBuffer(jsonData))
     if err != nil {
         return err
     }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("failed to update DNS record: %d", resp.StatusCode)
+    }
 
-    req.Header.Set("Content-Type", "application/json")
-    resp, err := c.client.Do(req)
+    return nil
+}
+
+func (c *UnifiClient) DeleteDNSRecord(recordID string) error {
+    resp, err := c.do("DELETE", "/proxy/network/api/s/default/rest/dnsrecord/"+recordID, nil)
     if err != nil {
         return err
     }
     defer resp.Body.Close()
 
     if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("failed to update DNS record: %d", resp.StatusCode)
+        return fmt.Errorf("failed to delete DNS record: %d", resp.StatusCode)
     }
 
     return nil
 }
 
-func (c *UnifiClient) DeleteDNSRecord(recordID string) error {
-    req, err := http.NewRequest(
-        "DELETE",
-        fmt.Sprintf("%s/proxy/network/api/s/default/rest/dnsrecord/%s", c.baseURL, recordID),
-        nil,
-    )
+// NetworkClient is a client known to the controller, merged from the active
+// client list and the configured (known) clients.
+type NetworkClient struct {
+    MAC        string `json:"mac"`
+    Name       string `json:"name"`
+    Hostname   string `json:"hostname"`
+    IP         string `json:"ip"`
+    FixedIP    string `json:"fixed_ip"`
+    UseFixedIP bool   `json:"use_fixedip"`
+    NetworkID  string `json:"network_id"`
+    Network    string `json:"network"`
+    VLAN       int    `json:"vlan"`
+}
+
+// Network is a network (LAN or VLAN) configured on the controller.
+type Network struct {
+    ID      string `json:"_id"`
+    Name    string `json:"name"`
+    VLAN    int    `json:"vlan"`
+    Purpose string `json:"purpose"`
+}
+
+// do sends a request to the controller, as JSON if there is a body.
+func (c *UnifiClient) do(method, path string, body io.Reader) (*http.Response, error) {
+    req, err := http.NewRequestWithContext(c.ctx, method, c.baseURL+path, body)
     if err != nil {
-        return err
+        return nil, err
+    }
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
     }
+    return c.client.Do(req)
+}
 
-    resp, err := c.client.Do(req)
+func (c *UnifiClient) get(path string, v interface{}) error {
+    resp, err := c.do("GET", path, nil)
     if err != nil {
         return err
     }
     defer resp.Body.Close()
 
     if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("failed to delete DNS record: %d", resp.StatusCode)
+        return fmt.Errorf("GET %s failed: %d", path, resp.StatusCode)
     }
 
-    return nil
+    result := struct {
+        Data interface{} `json:"data"`
+    }{Data: v}
+
+    return json.NewDecoder(resp.Body).Decode(&result)
+}
+
+// GetActiveClients returns the clients currently connected.
+func (c *UnifiClient) GetActiveClients() ([]NetworkClient, error) {
+    var clients []NetworkClient
+    err := c.get("/proxy/network/api/s/default/stat/sta", &clients)
+    return clients, err
+}
+
+// GetKnownClients returns the clients configured on the controller, which
+// includes offline clients with an alias or fixed IP. A client that is
+// forgotten on the controller disappears from this list.
+func (c *UnifiClient) GetKnownClients() ([]NetworkClient, error) {
+    var clients []NetworkClient
+    err := c.get("/proxy/network/api/s/default/rest/user", &clients)
+    return clients, err
+}
+
+func (c *UnifiClient) GetNetworks() ([]Network, error) {
+    var networks []Network
+    err := c.get("/proxy/network/api/s/default/rest/networkconf", &networks)
+    return networks, err
 }
@@ -0,0 +1,149 @@
+// Package bootstrap initializes a new installation without the setup page,
+// for unattended deployments such as Docker.
+//
+// Settings come from an optional YAML file and are overridden by these
+// environment variables:
+//
+//	UDS_ADMIN_USERNAME, UDS_ADMIN_PASSWORD   the first admin account
+//	UDS_UNIFI_USERNAME, UDS_UNIFI_PASSWORD   global UniFi credentials
+//	UDS_SETUP_TOKEN                          token for the setup page
+//
+// Each variable may instead be given as <NAME>_FILE holding the path of a
+// file with the value, for Docker secrets. Bootstrapping only happens once:
+// an installation that is already set up is left alone.
+package bootstrap
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+
+    "github.com/google/uuid"
+    "gopkg.in/yaml.v3"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/config"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+)
+
+const minPasswordLength = 8
+
+type Account struct {
+    Username string `yaml:"username"`
+    Password string `yaml:"password"`
+}
+
+type Config struct {
+    Admin Account `yaml:"admin"`
+    // Unifi holds global credentials for the UniFi controllers; optional.
+    Unifi Account `yaml:"unifi"`
+}
+
+// Load reads path, if not empty, and applies the environment on top.
+func Load(path string) (*Config, error) {
+    var settings Config
+    if path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, err
+        }
+        if err := yaml.Unmarshal(data, &settings); err != nil {
+            return nil, fmt.Errorf("%s: %w", path, err)
+        }
+    }
+
+    for name, field := range map[string]*string{
+        "UDS_ADMIN_USERNAME": &settings.Admin.Username,
+        "UDS_ADMIN_PASSWORD": &settings.Admin.Password,
+        "UDS_UNIFI_USERNAME": &settings.Unifi.Username,
+        "UDS_UNIFI_PASSWORD": &settings.Unifi.Password,
+    } {
+        value, ok, err := config.Env(name)
+        if err != nil {
+            return nil, err
+        }
+        if ok {
+            *field = value
+        }
+    }
+
+    return &settings, nil
+}
+
+// Empty reports whether no admin account was configured.
+func (c *Config) Empty() bool {
+    return c.Admin.Username == "" && c.Admin.Password == ""
+}
+
+// Apply creates the admin account and global credentials and marks the
+// installation as set up. It returns false without changes when the
+// installation was already set up.
+func Apply(st *store.Store, settings *Config) (bool, error) {
+    if settings.Admin.Username == "" {
+        return false, errors.New("admin username is required")
+    }
+    if len(settings.Admin.Password) < minPasswordLength {
+        return false, fmt.Errorf("admin password must be at least %d characters", minPasswordLength)
+    }
+    if (settings.Unifi.Username == "") != (settings.Unifi.Password == "") {
+        return false, errors.New("UniFi credentials need both a username and a password")
+    }
+
+    appConfig, err := st.GetAppConfig()
+    if err != nil {
+        return false, err
+    }
+    if appConfig.IsInitialized {
+        return false, nil
+    }
+
+    admin := &models.User{
+        ID:       uuid.New().String(),
+        Username: settings.Admin.Username,
+        Role:     models.RoleAdmin,
+    }
+    if err := st.CreateUser(admin, settings.Admin.Password); err != nil {
+        return false, fmt.Errorf("admin account: %w", err)
+    }
+
+    if settings.Unifi.Username != "" {
+        creds := &models.UnifiCredentials{
+            ID:        uuid.New().String(),
+            Username:  settings.Unifi.Username,
+            Password:  settings.Unifi.Password,
+            IsGlobal:  true,
+            CreatedBy: admin.ID,
+        }
+        if err := st.CreateCredentials(creds); err != nil {
+            return false, fmt.Errorf("UniFi credentials: %w", err)
+        }
+        appConfig.GlobalCreds = creds
+    }
+
+    appConfig.IsInitialized = true
+    if err := st.SaveAppConfig(appConfig); err != nil {
+        return false, err
+    }
+
+    log.Printf("Bootstrap: created admin %s", admin.Username)
+    return true, nil
+}
+
+// SetupToken returns the token the setup page requires: UDS_SETUP_TOKEN if
+// set, or a new random token, in which case generated is true and the caller
+// should show it to the operator.
+func SetupToken() (token string, generated bool, err error) {
+    token, ok, err := config.Env("UDS_SETUP_TOKEN")
+    if err != nil || ok {
+        return token, false, err
+    }
+
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", false, err
+    }
+    return hex.EncodeToString(b), true, nil
+}
@@ -0,0 +1,224 @@
+// Package certs provides the server's TLS certificate, either from a
+// certificate and key file that are reloaded when they change, or as a
+// self-signed certificate kept in the data directory.
+package certs
+
+import (
+    "context"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "fmt"
+    "log"
+    "math/big"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const (
+    selfSignedValidity = 365 * 24 * time.Hour
+    // Self-signed certificates are replaced at startup once they are this
+    // close to expiry.
+    selfSignedRenewal = 30 * 24 * time.Hour
+)
+
+// Loader serves a certificate and key pair from disk, reloading them when
+// either file changes.
+type Loader struct {
+    certFile string
+    keyFile  string
+
+    mu       sync.RWMutex
+    cert     *tls.Certificate
+    modified time.Time
+}
+
+// NewLoader loads the pair, failing if it cannot be used.
+func NewLoader(certFile, keyFile string) (*Loader, error) {
+    l := &Loader{certFile: certFile, keyFile: keyFile}
+    if err := l.reload(); err != nil {
+        return nil, err
+    }
+    return l, nil
+}
+
+// GetCertificate is for tls.Config.GetCertificate.
+func (l *Loader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+    return l.cert, nil
+}
+
+// TLSConfig returns a server configuration using the loader.
+func (l *Loader) TLSConfig() *tls.Config {
+    return &tls.Config{
+        MinVersion:     tls.VersionTLS12,
+        GetCertificate: l.GetCertificate,
+    }
+}
+
+// Watch checks the files every interval until ctx is done and reloads them
+// when they change. A pair that fails to load keeps the previous one in use.
+func (l *Loader) Watch(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+
+        modified, err := l.lastModified()
+        if err != nil {
+            log.Printf("TLS: %v", err)
+            continue
+        }
+
+        l.mu.RLock()
+        changed := modified.After(l.modified)
+        l.mu.RUnlock()
+        if !changed {
+            continue
+        }
+
+        if err := l.reload(); err != nil {
+            log.Printf("TLS: keeping the current certificate: %v", err)
+            continue
+        }
+        log.Printf("TLS: reloaded certificate from %s", l.certFile)
+    }
+}
+
+func (l *Loader) reload() error {
+    modified, err := l.lastModified()
+    if err != nil {
+        return err
+    }
+
+    cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+    if err != nil {
+        return fmt.Errorf("loading %s: %w", l.certFile, err)
+    }
+
+    l.mu.Lock()
+    l.cert = &cert
+    l.modified = modified
+    l.mu.Unlock()
+    return nil
+}
+
+// lastModified returns the later modification time of the two files.
+func (l *Loader) lastModified() (time.Time, error) {
+    var latest time.Time
+    for _, path := range []string{l.certFile, l.keyFile} {
+        info, err := os.Stat(path)
+        if err != nil {
+            return time.Time{}, err
+        }
+        if info.ModTime().After(latest) {
+            latest = info.ModTime()
+        }
+    }
+    return latest, nil
+}
+
+// SelfSigned returns the paths of a self-signed certificate and key for
+// hosts kept in dir, creating them when missing or close to expiry.
+func SelfSigned(dir string, hosts []string) (certFile, keyFile string, err error) {
+    certFile = filepath.Join(dir, "cert.pem")
+    keyFile = filepath.Join(dir, "key.pem")
+
+    if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+        leaf, err := x509.ParseCertificate(cert.Certificate[0])
+        if err == nil && time.Until(leaf.NotAfter) > selfSignedRenewal {
+            return certFile, keyFile, nil
+        }
+    }
+
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return "", "", err
+    }
+
+    certPEM, keyPEM, err := generate(hosts)
+    if err != nil {
+        return "", "", err
+    }
+    if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+        return "", "", err
+    }
+    if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+        return "", "", err
+    }
+
+    log.Printf("TLS: created a self-signed certificate for %v in %s", hosts, dir)
+    return certFile, keyFile, nil
+}
+
+func generate(hosts []string) ([]byte, []byte, error) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return nil, nil, err
+    }
+
+    now := time.Now()
+    template := &x509.Certificate{
+        SerialNumber:          serial,
+        Subject:               pkix.Name{Organization: []string{"Unifi DNS Manager"}, CommonName: hosts[0]},
+        NotBefore:             now.Add(-time.Hour),
+        NotAfter:              now.Add(selfSignedValidity),
+        KeyUsage:              x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        BasicConstraintsValid: true,
+    }
+    for _, host := range hosts {
+        if ip := net.ParseIP(host); ip != nil {
+            template.IPAddresses = append(template.IPAddresses, ip)
+        } else {
+            template.DNSNames = append(template.DNSNames, host)
+        }
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        return nil, nil, err
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+    keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+    return certPEM, keyPEM, nil
+}
+
+// RedirectHandler sends every request to the same host on HTTPS port
+// httpsPort.
+func RedirectHandler(httpsPort int) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        host := r.Host
+        if h, _, err := net.SplitHostPort(host); err == nil {
+            host = h
+        }
+        if httpsPort != 443 {
+            host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+        }
+        http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+    })
+}
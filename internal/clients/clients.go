@@ -0,0 +1,283 @@
+// Package clients publishes the clients known to each UniFi controller as
+// DNS records, using the alias given to the client on the controller as the
+// host name under the device's client domain.
+//
+// A client's fixed IP is used when it has one, otherwise its current
+// address. Clients without an alias or an address are skipped, and records
+// disappear when the client is forgotten on the controller.
+package clients
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/api"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/logging"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/syncer"
+)
+
+type Importer struct {
+    store    *store.Store
+    syncer   *syncer.Syncer
+    interval time.Duration
+}
+
+func NewImporter(store *store.Store, syncer *syncer.Syncer, interval time.Duration) *Importer {
+    return &Importer{
+        store:    store,
+        syncer:   syncer,
+        interval: interval,
+    }
+}
+
+// Run imports the clients of every device with client sync enabled each
+// interval until ctx is cancelled.
+func (im *Importer) Run(ctx context.Context) {
+    ticker := time.NewTicker(im.interval)
+    defer ticker.Stop()
+
+    for {
+        im.SyncAll(logging.NewContext(context.Background(), "import_id", logging.NewID()))
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+func (im *Importer) SyncAll(ctx context.Context) {
+    logger := logging.FromContext(ctx)
+    devices, err := im.store.ListDevices()
+    if err != nil {
+        logger.Error("Clients: failed to list devices", "error", err)
+        return
+    }
+
+    changed := false
+    for _, device := range devices {
+        n, err := im.SyncDevice(ctx, device)
+        if err != nil {
+            logger.Error("Clients: import failed", "device", device.Name, "device_id", device.ID, "error", err)
+            continue
+        }
+        changed = changed || n > 0
+    }
+
+    if changed {
+        im.syncer.Trigger()
+    }
+}
+
+// SyncDevice reconciles the client records of one device and returns the
+// number of records that changed. Devices without client sync settings have
+// their client records removed.
+func (im *Importer) SyncDevice(ctx context.Context, device *models.UnifiDevice) (int, error) {
+    var desired []*models.DNSRecord
+
+    if settings := device.ClientSync; settings != nil && settings.Domain != "" {
+        var clients []api.NetworkClient
+        err := im.syncer.WithClient(ctx, device.ID, func(client *api.UnifiClient) error {
+            var err error
+            clients, err = fetch(client)
+            return err
+        })
+        if err != nil {
+            return 0, err
+        }
+
+        desired = Records(device, clients)
+    }
+
+    created, updated, deleted, err := im.store.ReconcileSource(models.SourceClients, device.ID, desired)
+    if err != nil {
+        return 0, err
+    }
+
+    if created+deleted > 0 {
+        logging.FromContext(ctx).Info("Clients: imported client records", "device", device.Name,
+            "records", len(desired), "created", created, "deleted", deleted)
+    }
+    return created + updated + deleted, nil
+}
+
+// fetch merges the known and active clients by MAC address, filling in
+// network names and VLANs from the network configuration.
+func fetch(client *api.UnifiClient) ([]api.NetworkClient, error) {
+    known, err := client.GetKnownClients()
+    if err != nil {
+        return nil, fmt.Errorf("known clients: %w", err)
+    }
+    active, err := client.GetActiveClients()
+    if err != nil {
+        return nil, fmt.Errorf("active clients: %w", err)
+    }
+    networks, err := client.GetNetworks()
+    if err != nil {
+        return nil, fmt.Errorf("networks: %w", err)
+    }
+
+    byMAC := make(map[string]*api.NetworkClient)
+    for i := range known {
+        c := known[i]
+        byMAC[strings.ToLower(c.MAC)] = &c
+    }
+    for _, a := range active {
+        mac := strings.ToLower(a.MAC)
+        c, ok := byMAC[mac]
+        if !ok {
+            a := a
+            byMAC[mac] = &a
+            continue
+        }
+        c.IP = a.IP
+        if c.Name == "" {
+            c.Name = a.Name
+        }
+        if c.NetworkID == "" {
+            c.NetworkID = a.NetworkID
+        }
+        c.Network, c.VLAN = a.Network, a.VLAN
+    }
+
+    byID := make(map[string]api.Network)
+    for _, n := range networks {
+        byID[n.ID] = n
+    }
+
+    var clients []api.NetworkClient
+    for _, c := range byMAC {
+        if n, ok := byID[c.NetworkID]; ok {
+            if c.Network == "" {
+                c.Network = n.Name
+            }
+            if c.VLAN == 0 {
+                c.VLAN = n.VLAN
+            }
+        }
+        clients = append(clients, *c)
+    }
+
+    sort.Slice(clients, func(i, j int) bool { return clients[i].MAC < clients[j].MAC })
+    return clients, nil
+}
+
+// Records maps clients to records for device, applying its network filters.
+// When two clients share an alias the one with the lowest MAC address wins.
+func Records(device *models.UnifiDevice, clients []api.NetworkClient) []*models.DNSRecord {
+    settings := device.ClientSync
+    domain := strings.Trim(strings.ToLower(settings.Domain), ".")
+
+    var records []*models.DNSRecord
+    owners := make(map[string]string)
+
+    for _, c := range clients {
+        if !admitted(settings, c) {
+            continue
+        }
+
+        label := hostLabel(c.Name)
+        if label == "" {
+            continue
+        }
+
+        address := c.IP
+        if c.UseFixedIP && c.FixedIP != "" {
+            address = c.FixedIP
+        }
+        if address == "" {
+            continue
+        }
+
+        name := label + "." + domain
+        if owner, ok := owners[name]; ok {
+            log.Printf("Clients: %s is used by %s and %s; keeping %s", name, owner, c.MAC, owner)
+            continue
+        }
+
+        record := &models.DNSRecord{
+            ID:          uuid.New().String(),
+            Name:        name,
+            RRType:      "A",
+            Value:       address,
+            DeviceID:    device.ID,
+            Enabled:     true,
+            Description: "client " + c.MAC,
+            CreatedBy:   models.SourceClients,
+            Source:      models.SourceClients,
+            ReadOnly:    true,
+        }
+        if strings.Contains(address, ":") {
+            record.RRType = "AAAA"
+        }
+        if err := record.Validate(); err != nil {
+            log.Printf("Clients: %s (%s): %v", name, c.MAC, err)
+            continue
+        }
+
+        owners[name] = c.MAC
+        records = append(records, record)
+    }
+
+    return records
+}
+
+// admitted applies the include and exclude network filters.
+func admitted(settings *models.ClientSyncSettings, c api.NetworkClient) bool {
+    for _, f := range settings.Exclude {
+        if matches(f, c) {
+            return false
+        }
+    }
+    if len(settings.Include) == 0 {
+        return true
+    }
+    for _, f := range settings.Include {
+        if matches(f, c) {
+            return true
+        }
+    }
+    return false
+}
+
+func matches(filter string, c api.NetworkClient) bool {
+    filter = strings.TrimSpace(filter)
+    if vlan := strings.TrimPrefix(strings.ToLower(filter), "vlan:"); vlan != strings.ToLower(filter) {
+        id, err := strconv.Atoi(vlan)
+        return err == nil && id == c.VLAN
+    }
+    return filter != "" && (strings.EqualFold(filter, c.Network) || filter == c.NetworkID)
+}
+
+// hostLabel turns a client alias into a DNS label: lower case letters,
+// digits and single hyphens.
+func hostLabel(alias string) string {
+    var b strings.Builder
+    hyphen := false
+    for _, r := range strings.ToLower(strings.TrimSpace(alias)) {
+        switch {
+        case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+            b.WriteRune(r)
+            hyphen = false
+        case !hyphen && b.Len() > 0:
+            b.WriteByte('-')
+            hyphen = true
+        }
+    }
+
+    label := strings.TrimSuffix(b.String(), "-")
+    if len(label) > 63 {
+        label = strings.TrimSuffix(label[:63], "-")
+    }
+    return label
+}
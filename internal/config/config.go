@@ -0,0 +1,437 @@
+// Package config assembles the server configuration from, in increasing
+// order of precedence:
+//
+//  1. built-in defaults
+//  2. a YAML file named by -config or UDS_CONFIG
+//  3. environment variables
+//  4. command line flags
+//
+// Every flag has an environment variable named UDS_ followed by the flag
+// name in upper case with dashes as underscores, so -oidc-client-secret is
+// UDS_OIDC_CLIENT_SECRET. Variables may also be given as <NAME>_FILE, the
+// path of a file holding the value, for Docker secrets. PORT, DATA_DIR and
+// DEBUG are accepted as well for existing container setups.
+//
+// The file uses the sections of Config, for example:
+//
+//	port: 52638
+//	data_dir: /app/data
+//	oidc:
+//	  issuer: https://sso.example.com
+//	  client_id: unifi-dns
+//	session:
+//	  idle_timeout: 1h
+//	tls:
+//	  self_signed: true
+//	  hosts: dns.example.com,192.168.1.10
+package config
+
+import (
+    "bytes"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "reflect"
+    "strings"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+type Config struct {
+    Port         int           `yaml:"port"`
+    DataDir      string        `yaml:"data_dir"`
+    Debug        bool          `yaml:"debug"`
+    SyncInterval time.Duration `yaml:"sync_interval"`
+    CORSOrigins  string        `yaml:"cors_origins"`
+    // ShutdownTimeout bounds how long stopping waits for requests and
+    // syncs in progress.
+    ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+    // BootstrapFile names a file with the first admin account, see package
+    // bootstrap.
+    BootstrapFile string `yaml:"bootstrap_file"`
+
+    GitOps      GitOps      `yaml:"gitops"`
+    ExternalDNS ExternalDNS `yaml:"external_dns"`
+    Docker      Docker      `yaml:"docker"`
+    RFC2136     RFC2136     `yaml:"rfc2136"`
+    DNS         DNS         `yaml:"dns"`
+    Verify      Verify      `yaml:"verify"`
+    Clients     Clients     `yaml:"clients"`
+    OIDC        OIDC        `yaml:"oidc"`
+    Session     Session     `yaml:"session"`
+    TLS         TLS         `yaml:"tls"`
+    Metrics     Metrics     `yaml:"metrics"`
+    Log         Log         `yaml:"log"`
+}
+
+type GitOps struct {
+    Dir      string        `yaml:"dir"`
+    Interval time.Duration `yaml:"interval"`
+}
+
+// ExternalDNS serves the external-dns webhook provider on Listen, which
+// must be a loopback address unless Token is required as a bearer token.
+type ExternalDNS struct {
+    Listen string `yaml:"listen"`
+    Token  string `yaml:"token" secret:"true"`
+}
+
+type Docker struct {
+    Socket   string        `yaml:"socket"`
+    Interval time.Duration `yaml:"interval"`
+}
+
+type RFC2136 struct {
+    Listen   string `yaml:"listen"`
+    Zones    string `yaml:"zones"`
+    TSIGKeys string `yaml:"tsig_keys" secret:"true"`
+}
+
+type DNS struct {
+    Listen         string        `yaml:"listen"`
+    Device         string        `yaml:"device"`
+    TTL            time.Duration `yaml:"ttl"`
+    ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type Verify struct {
+    Interval time.Duration `yaml:"interval"`
+}
+
+type Clients struct {
+    Interval time.Duration `yaml:"interval"`
+}
+
+type OIDC struct {
+    Issuer       string `yaml:"issuer"`
+    ClientID     string `yaml:"client_id"`
+    ClientSecret string `yaml:"client_secret" secret:"true"`
+    RedirectURL  string `yaml:"redirect_url"`
+    GroupsClaim  string `yaml:"groups_claim"`
+    RoleMap      string `yaml:"role_map"`
+    DefaultRole  string `yaml:"default_role"`
+}
+
+type Session struct {
+    IdleTimeout time.Duration `yaml:"idle_timeout"`
+    MaxAge      time.Duration `yaml:"max_age"`
+}
+
+// TLS serves HTTPS from CertFile and KeyFile, or from a certificate
+// generated in the data directory when SelfSigned is set.
+type TLS struct {
+    CertFile       string        `yaml:"cert_file"`
+    KeyFile        string        `yaml:"key_file"`
+    SelfSigned     bool          `yaml:"self_signed"`
+    Hosts          string        `yaml:"hosts"`
+    ReloadInterval time.Duration `yaml:"reload_interval"`
+    RedirectListen string        `yaml:"redirect_listen"`
+}
+
+// Metrics serves Prometheus metrics at /metrics, requiring Token as a bearer
+// token. Without a token they are only served if Public is set.
+type Metrics struct {
+    Enabled bool   `yaml:"enabled"`
+    Token   string `yaml:"token" secret:"true"`
+    Public  bool   `yaml:"public"`
+}
+
+// Log sets the level (debug, info, warn or error) and format (text or json)
+// of the log. Debug turns on debug level with source locations.
+type Log struct {
+    Level  string `yaml:"level"`
+    Format string `yaml:"format"`
+}
+
+// Enabled reports whether the server should serve HTTPS.
+func (t TLS) Enabled() bool {
+    return t.CertFile != "" || t.SelfSigned
+}
+
+// Default returns the built-in defaults.
+func Default() *Config {
+    return &Config{
+        Port:            52638,
+        DataDir:         "data",
+        SyncInterval:    5 * time.Minute,
+        ShutdownTimeout: 20 * time.Second,
+        GitOps:          GitOps{Interval: 30 * time.Second},
+        Docker:          Docker{Interval: 15 * time.Second},
+        DNS:             DNS{TTL: 60 * time.Second, ReloadInterval: 10 * time.Second},
+        Verify:          Verify{Interval: 15 * time.Minute},
+        Clients:         Clients{Interval: 5 * time.Minute},
+        OIDC:            OIDC{GroupsClaim: "groups", DefaultRole: "viewer"},
+        Session:         Session{IdleTimeout: 2 * time.Hour, MaxAge: 24 * time.Hour},
+        TLS:             TLS{Hosts: "localhost,127.0.0.1", ReloadInterval: time.Minute},
+        Metrics:         Metrics{Enabled: true},
+        Log:             Log{Level: "info", Format: "text"},
+    }
+}
+
+// RegisterFlags defines a flag for every setting, bound to c.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+    fs.IntVar(&c.Port, "port", c.Port, "Port to run the server on")
+    fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "Directory for data storage")
+    fs.BoolVar(&c.Debug, "debug", c.Debug, "Enable debug logging")
+    fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "Log level: debug, info, warn or error")
+    fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "Log format: text or json")
+    fs.StringVar(&c.GitOps.Dir, "gitops-dir", c.GitOps.Dir, "Directory of YAML record files to apply (disabled when empty)")
+    fs.DurationVar(&c.GitOps.Interval, "gitops-interval", c.GitOps.Interval, "How often to check the GitOps directory for changes")
+    fs.DurationVar(&c.SyncInterval, "sync-interval", c.SyncInterval, "How often to push records to the UniFi devices")
+    fs.StringVar(&c.ExternalDNS.Listen, "external-dns-listen", c.ExternalDNS.Listen, "Address for the external-dns webhook provider, e.g. 127.0.0.1:8888 (disabled when empty)")
+    fs.StringVar(&c.ExternalDNS.Token, "external-dns-token", c.ExternalDNS.Token, "Bearer token required by the external-dns webhook provider; without one it may only listen on loopback")
+    fs.StringVar(&c.Docker.Socket, "docker-socket", c.Docker.Socket, "Docker Engine socket to discover labelled containers from, e.g. /var/run/docker.sock (disabled when empty)")
+    fs.DurationVar(&c.Docker.Interval, "docker-interval", c.Docker.Interval, "How often to check running containers")
+    fs.StringVar(&c.RFC2136.Listen, "rfc2136-listen", c.RFC2136.Listen, "Address for the RFC 2136 dynamic update listener, e.g. :5353 (disabled when empty)")
+    fs.StringVar(&c.RFC2136.Zones, "rfc2136-zones", c.RFC2136.Zones, "Comma separated zone=device bindings for dynamic updates")
+    fs.StringVar(&c.RFC2136.TSIGKeys, "rfc2136-tsig-keys", c.RFC2136.TSIGKeys, "Comma separated name:algorithm:base64-secret TSIG keys; required with -rfc2136-listen")
+    fs.StringVar(&c.DNS.Listen, "dns-listen", c.DNS.Listen, "Address to serve the managed records over DNS, e.g. :5300 (disabled when empty)")
+    fs.StringVar(&c.DNS.Device, "dns-device", c.DNS.Device, "Only serve the records of this device ID (all devices when empty)")
+    fs.DurationVar(&c.DNS.TTL, "dns-ttl", c.DNS.TTL, "TTL of records served over DNS")
+    fs.DurationVar(&c.DNS.ReloadInterval, "dns-reload-interval", c.DNS.ReloadInterval, "How often the DNS server reloads the records it serves")
+    fs.DurationVar(&c.Verify.Interval, "verify-interval", c.Verify.Interval, "How often to check that records resolve through each device (0 disables)")
+    fs.DurationVar(&c.Clients.Interval, "clients-interval", c.Clients.Interval, "How often to import UniFi client aliases for devices with client sync enabled")
+    fs.StringVar(&c.OIDC.Issuer, "oidc-issuer", c.OIDC.Issuer, "OpenID Connect issuer URL for single sign-on (disabled when empty)")
+    fs.StringVar(&c.OIDC.ClientID, "oidc-client-id", c.OIDC.ClientID, "OpenID Connect client ID")
+    fs.StringVar(&c.OIDC.ClientSecret, "oidc-client-secret", c.OIDC.ClientSecret, "OpenID Connect client secret")
+    fs.StringVar(&c.OIDC.RedirectURL, "oidc-redirect-url", c.OIDC.RedirectURL, "Callback URL registered with the provider, e.g. https://dns.example.com/auth/oidc/callback")
+    fs.StringVar(&c.OIDC.GroupsClaim, "oidc-groups-claim", c.OIDC.GroupsClaim, "ID token claim that lists the user's groups")
+    fs.StringVar(&c.OIDC.RoleMap, "oidc-role-map", c.OIDC.RoleMap, "Comma separated group=role mappings, e.g. dns-admins=admin,netops=operator")
+    fs.StringVar(&c.OIDC.DefaultRole, "oidc-default-role", c.OIDC.DefaultRole, "Role for users in no mapped group (empty denies them)")
+    fs.DurationVar(&c.Session.IdleTimeout, "session-idle-timeout", c.Session.IdleTimeout, "Sign out sessions unused for this long (0 disables)")
+    fs.DurationVar(&c.Session.MaxAge, "session-max-age", c.Session.MaxAge, "Sign out sessions this long after they started")
+    fs.StringVar(&c.BootstrapFile, "bootstrap-file", c.BootstrapFile, "YAML file with the first admin account and global UniFi credentials, for unattended setup")
+    fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "PEM certificate to serve HTTPS with, reloaded when it changes")
+    fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "PEM private key for -tls-cert")
+    fs.BoolVar(&c.TLS.SelfSigned, "tls-self-signed", c.TLS.SelfSigned, "Serve HTTPS with a self-signed certificate kept in the data directory")
+    fs.StringVar(&c.TLS.Hosts, "tls-hosts", c.TLS.Hosts, "Comma separated host names and IPs for the self-signed certificate")
+    fs.DurationVar(&c.TLS.ReloadInterval, "tls-reload-interval", c.TLS.ReloadInterval, "How often to check the certificate files for changes")
+    fs.StringVar(&c.TLS.RedirectListen, "tls-redirect-listen", c.TLS.RedirectListen, "Address for a plain HTTP listener that redirects to HTTPS, e.g. :80 (disabled when empty)")
+    fs.BoolVar(&c.Metrics.Enabled, "metrics", c.Metrics.Enabled, "Serve Prometheus metrics at /metrics")
+    fs.StringVar(&c.Metrics.Token, "metrics-token", c.Metrics.Token, "Bearer token required to read /metrics")
+    fs.BoolVar(&c.Metrics.Public, "metrics-public", c.Metrics.Public, "Serve /metrics without a token")
+    fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "How long to wait for requests and syncs in progress when stopping")
+    fs.StringVar(&c.CORSOrigins, "cors-origins", c.CORSOrigins, "Comma separated origins allowed to call the API from other sites, e.g. https://dash.example.com")
+}
+
+// legacyEnv are variables read by earlier container images.
+var legacyEnv = map[string]string{
+    "port":     "PORT",
+    "data-dir": "DATA_DIR",
+    "debug":    "DEBUG",
+}
+
+// Load parses args with fs and merges them over the environment, the
+// configuration file and the defaults, then validates the result.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+    c := Default()
+    path := fs.String("config", "", "YAML configuration file (UDS_CONFIG)")
+    c.RegisterFlags(fs)
+
+    if err := fs.Parse(args); err != nil {
+        return nil, err
+    }
+
+    // Remember the flags given on the command line, then build up from the
+    // defaults again so that they are applied last.
+    explicit := make(map[string]string)
+    fs.Visit(func(f *flag.Flag) {
+        explicit[f.Name] = f.Value.String()
+    })
+    *c = *Default()
+
+    file := *path
+    if file == "" {
+        file = os.Getenv("UDS_CONFIG")
+    }
+    if file != "" {
+        if err := c.loadFile(file); err != nil {
+            return nil, err
+        }
+    }
+
+    if err := applyEnv(fs); err != nil {
+        return nil, err
+    }
+
+    for name, value := range explicit {
+        if err := fs.Set(name, value); err != nil {
+            return nil, fmt.Errorf("-%s: %w", name, err)
+        }
+    }
+
+    return c, c.Validate()
+}
+
+func (c *Config) loadFile(path string) error {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+
+    decoder := yaml.NewDecoder(bytes.NewReader(data))
+    decoder.KnownFields(true)
+    if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+        return fmt.Errorf("%s: %w", path, err)
+    }
+    return nil
+}
+
+func applyEnv(fs *flag.FlagSet) error {
+    var err error
+    fs.VisitAll(func(f *flag.Flag) {
+        if err != nil || f.Name == "config" {
+            return
+        }
+
+        name := EnvName(f.Name)
+        value, ok, lookupErr := Env(name)
+        if !ok && lookupErr == nil && legacyEnv[f.Name] != "" {
+            name = legacyEnv[f.Name]
+            value, ok, lookupErr = Env(name)
+        }
+        if lookupErr != nil {
+            err = lookupErr
+            return
+        }
+        if ok {
+            if setErr := fs.Set(f.Name, value); setErr != nil {
+                err = fmt.Errorf("invalid value %q for %s: %v", value, name, setErr)
+            }
+        }
+    })
+    return err
+}
+
+// EnvName returns the environment variable for a flag.
+func EnvName(flagName string) string {
+    return "UDS_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Env looks up name in the environment, or reads the file named by
+// name_FILE. Empty variables count as unset.
+func Env(name string) (string, bool, error) {
+    if value := os.Getenv(name); value != "" {
+        return value, true, nil
+    }
+
+    path := os.Getenv(name + "_FILE")
+    if path == "" {
+        return "", false, nil
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return "", false, fmt.Errorf("%s_FILE: %w", name, err)
+    }
+    return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+    var problems []string
+    check := func(ok bool, format string, args ...interface{}) {
+        if !ok {
+            problems = append(problems, fmt.Sprintf(format, args...))
+        }
+    }
+
+    check(c.Port > 0 && c.Port < 65536, "port %d is out of range", c.Port)
+    check(c.DataDir != "", "data_dir is required")
+    check(c.SyncInterval > 0, "sync_interval must be positive")
+    check(c.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+    check(oneOf(c.Log.Level, "debug", "info", "warn", "error"), "log.level must be debug, info, warn or error")
+    check(oneOf(c.Log.Format, "text", "json"), "log.format must be text or json")
+    check(c.GitOps.Interval > 0, "gitops.interval must be positive")
+    check(c.Docker.Interval > 0, "docker.interval must be positive")
+    check(c.Clients.Interval > 0, "clients.interval must be positive")
+    check(c.Verify.Interval >= 0, "verify.interval must not be negative")
+    check(c.DNS.TTL >= time.Second, "dns.ttl must be at least 1s")
+    check(c.DNS.ReloadInterval > 0, "dns.reload_interval must be positive")
+    check(c.Session.MaxAge > 0, "session.max_age must be positive")
+    check(c.Session.IdleTimeout >= 0, "session.idle_timeout must not be negative")
+    check(c.ExternalDNS.Listen == "" || c.ExternalDNS.Token != "" || isLoopback(c.ExternalDNS.Listen),
+        "external_dns.listen must be a loopback address unless external_dns.token is set")
+    check(c.RFC2136.Listen == "" || c.RFC2136.Zones != "", "rfc2136.zones is required with rfc2136.listen")
+    check(c.RFC2136.Listen == "" || c.RFC2136.TSIGKeys != "", "rfc2136.tsig_keys is required with rfc2136.listen")
+    check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.cert_file and tls.key_file must be set together")
+    check(c.TLS.CertFile == "" || !c.TLS.SelfSigned, "tls.self_signed cannot be combined with tls.cert_file")
+    check(!c.TLS.SelfSigned || strings.TrimSpace(c.TLS.Hosts) != "", "tls.hosts is required with tls.self_signed")
+    check(c.TLS.ReloadInterval > 0, "tls.reload_interval must be positive")
+    check(c.TLS.RedirectListen == "" || c.TLS.Enabled(), "tls.redirect_listen needs tls.cert_file or tls.self_signed")
+    if c.OIDC.Issuer != "" {
+        check(c.OIDC.ClientID != "", "oidc.client_id is required with oidc.issuer")
+        check(c.OIDC.RedirectURL != "", "oidc.redirect_url is required with oidc.issuer")
+    }
+
+    if len(problems) > 0 {
+        return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+    }
+    return nil
+}
+
+// isLoopback reports whether the listen address addr only accepts
+// connections from this host.
+func isLoopback(addr string) bool {
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        return false
+    }
+    if host == "localhost" {
+        return true
+    }
+    ip := net.ParseIP(host)
+    return ip != nil && ip.IsLoopback()
+}
+
+func oneOf(value string, allowed ...string) bool {
+    for _, a := range allowed {
+        if strings.EqualFold(value, a) {
+            return true
+        }
+    }
+    return false
+}
+
+// Redacted returns the configuration as YAML with secrets hidden.
+func (c *Config) Redacted() ([]byte, error) {
+    var buf bytes.Buffer
+    encoder := yaml.NewEncoder(&buf)
+    encoder.SetIndent(2)
+    if err := encoder.Encode(redact(reflect.ValueOf(*c))); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), encoder.Close()
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// redact builds a YAML node for v, writing durations the way they are
+// configured and hiding fields tagged secret.
+func redact(v reflect.Value) *yaml.Node {
+    if v.Type() == durationType {
+        return &yaml.Node{Kind: yaml.ScalarNode, Value: v.Interface().(time.Duration).String()}
+    }
+
+    if v.Kind() == reflect.Struct {
+        node := &yaml.Node{Kind: yaml.MappingNode}
+        for i := 0; i < v.NumField(); i++ {
+            field := v.Type().Field(i)
+            key := &yaml.Node{Kind: yaml.ScalarNode, Value: strings.Split(field.Tag.Get("yaml"), ",")[0]}
+
+            value := redact(v.Field(i))
+            if field.Tag.Get("secret") == "true" && v.Field(i).String() != "" {
+                value = &yaml.Node{Kind: yaml.ScalarNode, Value: "<redacted>"}
+            }
+            node.Content = append(node.Content, key, value)
+        }
+        return node
+    }
+
+    var node yaml.Node
+    node.Encode(v.Interface())
+    return &node
+}
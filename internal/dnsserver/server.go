@@ -0,0 +1,298 @@
+// Package dnsserver answers DNS queries from dns_records, so the desired
+// state can be queried with dig and compared with what the gateways answer,
+// or used directly at sites without a UniFi gateway.
+//
+// Only enabled records are served. The server is authoritative for the
+// domains of the served devices; names outside them use a synthesised zone
+// at their top-level label so that NXDOMAIN and NODATA answers still carry
+// an SOA. Wildcard records ("*.example.lan") match names below them that do
+// not exist themselves (RFC 4592), and CNAMEs are followed within the
+// served records.
+//
+// Queries are answered from a copy of the records held in memory, which Run
+// reloads each interval, so changes are served after at most one interval.
+package dnsserver
+
+import (
+    "context"
+    "log"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/miekg/dns"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/dnsutil"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+)
+
+// maxCNAMEChain bounds CNAME chasing so loops in the records end.
+const maxCNAMEChain = 8
+
+type Server struct {
+    store    *store.Store
+    deviceID string
+    ttl      uint32
+
+    // zone is what queries are answered from, replaced as a whole on reload.
+    zone atomic.Pointer[zone]
+
+    listenersMu sync.Mutex
+    listeners   []*dns.Server
+}
+
+// NewServer returns a server for the records of deviceID, or of every device
+// when deviceID is empty.
+func NewServer(store *store.Store, deviceID string, ttl time.Duration) *Server {
+    return &Server{
+        store:    store,
+        deviceID: deviceID,
+        ttl:      uint32(ttl / time.Second),
+    }
+}
+
+// Run reloads the served records each interval until ctx is cancelled. A
+// failed reload is logged and the previous records stay in service.
+func (s *Server) Run(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+
+        if err := s.Reload(); err != nil {
+            log.Printf("DNS: failed to reload records: %v", err)
+        }
+    }
+}
+
+// Reload reads the served records from the store.
+func (s *Server) Reload() error {
+    z, err := s.load()
+    if err != nil {
+        return err
+    }
+    s.zone.Store(z)
+    return nil
+}
+
+// ListenAndServe loads the records and then serves queries over UDP and TCP
+// on addr until one of the listeners fails or Shutdown is called.
+func (s *Server) ListenAndServe(addr string) error {
+    if err := s.Reload(); err != nil {
+        return err
+    }
+
+    errs := make(chan error, 2)
+    for _, network := range []string{"udp", "tcp"} {
+        server := &dns.Server{Addr: addr, Net: network, Handler: s}
+        s.listenersMu.Lock()
+        s.listeners = append(s.listeners, server)
+        s.listenersMu.Unlock()
+        go func() {
+            errs <- server.ListenAndServe()
+        }()
+    }
+    return <-errs
+}
+
+// Shutdown stops the listeners, waiting for requests in progress until ctx
+// is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+    s.listenersMu.Lock()
+    listeners := s.listeners
+    s.listeners = nil
+    s.listenersMu.Unlock()
+
+    var firstErr error
+    for _, server := range listeners {
+        if err := server.ShutdownContext(ctx); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
+
+// zone holds the records being served, indexed by lower-case name without
+// the trailing dot.
+type zone struct {
+    records map[string][]*models.DNSRecord
+    // names also contains every ancestor of a record name (empty
+    // non-terminals), which matters for NODATA and wildcard matching.
+    names   map[string]bool
+    domains []string
+}
+
+func (s *Server) load() (*zone, error) {
+    records, err := s.store.ListDNSRecords(s.deviceID)
+    if err != nil {
+        return nil, err
+    }
+
+    devices, err := s.store.ListDevices()
+    if err != nil {
+        return nil, err
+    }
+
+    z := &zone{
+        records: make(map[string][]*models.DNSRecord),
+        names:   make(map[string]bool),
+    }
+    for _, device := range devices {
+        if s.deviceID == "" || device.ID == s.deviceID {
+            z.domains = append(z.domains, device.Domains...)
+        }
+    }
+
+    for _, record := range records {
+        if !record.Enabled {
+            continue
+        }
+        name := strings.ToLower(record.Name)
+        z.records[name] = append(z.records[name], record)
+        for n := name; n != ""; n = parent(n) {
+            z.names[n] = true
+        }
+    }
+
+    return z, nil
+}
+
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+    m := new(dns.Msg)
+    m.SetReply(r)
+    m.Authoritative = true
+
+    if len(r.Question) != 1 || r.Question[0].Qclass != dns.ClassINET {
+        m.SetRcode(r, dns.RcodeRefused)
+        w.WriteMsg(m)
+        return
+    }
+
+    z := s.zone.Load()
+    if z == nil {
+        m.SetRcode(r, dns.RcodeServerFailure)
+        w.WriteMsg(m)
+        return
+    }
+
+    q := r.Question[0]
+    s.answer(m, z, strings.ToLower(strings.TrimSuffix(q.Name, ".")), q.Qtype)
+    w.WriteMsg(m)
+}
+
+func (s *Server) answer(m *dns.Msg, z *zone, qname string, qtype uint16) {
+    name := qname
+    for i := 0; i < maxCNAMEChain; i++ {
+        records, exists := z.lookup(name)
+        if !exists {
+            if i == 0 {
+                m.Rcode = dns.RcodeNameError
+            }
+            break
+        }
+
+        // A CNAME stands in for every other type unless it is what was
+        // asked for; follow it to the target.
+        var cname *models.DNSRecord
+        for _, record := range records {
+            if record.RRType == "CNAME" && qtype != dns.TypeCNAME && qtype != dns.TypeANY {
+                cname = record
+                break
+            }
+        }
+
+        if cname == nil {
+            for _, record := range records {
+                if qtype != dns.TypeANY && dns.StringToType[record.RRType] != qtype {
+                    continue
+                }
+                if rr := s.rr(name, record); rr != nil {
+                    m.Answer = append(m.Answer, rr)
+                }
+            }
+            break
+        }
+
+        rr := s.rr(name, cname)
+        if rr == nil {
+            break
+        }
+        m.Answer = append(m.Answer, rr)
+        name = strings.ToLower(cname.Value)
+    }
+
+    if len(m.Answer) == 0 {
+        m.Ns = append(m.Ns, s.soa(z, qname))
+    }
+}
+
+// lookup returns the records for name, falling back to a wildcard at the
+// closest existing ancestor. The second result reports whether the name
+// exists at all, either directly, as an empty non-terminal, or through a
+// wildcard.
+func (z *zone) lookup(name string) ([]*models.DNSRecord, bool) {
+    if z.names[name] {
+        return z.records[name], true
+    }
+
+    for encloser := parent(name); encloser != ""; encloser = parent(encloser) {
+        if !z.names[encloser] {
+            continue
+        }
+        records, ok := z.records["*."+encloser]
+        return records, ok
+    }
+
+    records, ok := z.records["*"]
+    return records, ok
+}
+
+// rr renders record under owner, which differs from the record name when a
+// wildcard matched.
+func (s *Server) rr(owner string, record *models.DNSRecord) dns.RR {
+    rr, err := dnsutil.RR(owner, record.RRType, record.Value, s.ttl)
+    if err != nil {
+        log.Printf("DNS: record %s %s: %v", record.Name, record.RRType, err)
+        return nil
+    }
+    return rr
+}
+
+// soa returns the SOA of the zone qname belongs to, for negative answers.
+func (s *Server) soa(z *zone, qname string) dns.RR {
+    apex := ""
+    for _, domain := range z.domains {
+        domain = strings.ToLower(strings.Trim(domain, "."))
+        if (qname == domain || strings.HasSuffix(qname, "."+domain)) && len(domain) > len(apex) {
+            apex = domain
+        }
+    }
+    if apex == "" {
+        apex = qname[strings.LastIndex(qname, ".")+1:]
+    }
+
+    return &dns.SOA{
+        Hdr:     dns.RR_Header{Name: dns.Fqdn(apex), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.ttl},
+        Ns:      dns.Fqdn("ns." + apex),
+        Mbox:    dns.Fqdn("hostmaster." + apex),
+        Serial:  uint32(time.Now().Unix()),
+        Refresh: 3600,
+        Retry:   600,
+        Expire:  86400,
+        Minttl:  s.ttl,
+    }
+}
+
+func parent(name string) string {
+    if i := strings.IndexByte(name, '.'); i >= 0 {
+        return name[i+1:]
+    }
+    return ""
+}
@@ -0,0 +1,74 @@
+// Package dnsutil converts between dns_records rows and DNS resource records.
+//
+// Values are stored the way the UniFi controller shows them: addresses and
+// host names without a trailing dot, TXT as a single string, MX as
+// "preference host" and SRV as "priority weight port target".
+package dnsutil
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// Value renders the RDATA of rr the way it is stored in dns_records. It
+// returns false for types the controllers do not support.
+func Value(rr dns.RR) (string, bool) {
+    switch v := rr.(type) {
+    case *dns.A:
+        return v.A.String(), true
+    case *dns.AAAA:
+        return v.AAAA.String(), true
+    case *dns.CNAME:
+        return strings.TrimSuffix(v.Target, "."), true
+    case *dns.TXT:
+        return strings.Join(v.Txt, ""), true
+    case *dns.MX:
+        return fmt.Sprintf("%d %s", v.Preference, strings.TrimSuffix(v.Mx, ".")), true
+    case *dns.SRV:
+        return fmt.Sprintf("%d %d %d %s", v.Priority, v.Weight, v.Port, strings.TrimSuffix(v.Target, ".")), true
+    case *dns.NS:
+        return strings.TrimSuffix(v.Ns, "."), true
+    case *dns.PTR:
+        return strings.TrimSuffix(v.Ptr, "."), true
+    }
+    return "", false
+}
+
+// RR builds a resource record for a stored record.
+func RR(name, rrtype, value string, ttl uint32) (dns.RR, error) {
+    hdr := dns.RR_Header{
+        Name:  dns.Fqdn(name),
+        Class: dns.ClassINET,
+        Ttl:   ttl,
+    }
+
+    switch strings.ToUpper(rrtype) {
+    case "TXT":
+        // Split long values into character strings of at most 255 bytes.
+        hdr.Rrtype = dns.TypeTXT
+        txt := &dns.TXT{Hdr: hdr}
+        for len(value) > 255 {
+            txt.Txt = append(txt.Txt, value[:255])
+            value = value[255:]
+        }
+        txt.Txt = append(txt.Txt, value)
+        return txt, nil
+
+    case "A", "AAAA":
+        return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", hdr.Name, ttl, strings.ToUpper(rrtype), value))
+
+    case "CNAME", "MX", "SRV", "NS", "PTR":
+        // The host name is always the last field and is stored without the
+        // trailing dot.
+        fields := strings.Fields(value)
+        if len(fields) == 0 {
+            return nil, fmt.Errorf("empty %s value", rrtype)
+        }
+        fields[len(fields)-1] = dns.Fqdn(fields[len(fields)-1])
+        return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", hdr.Name, ttl, strings.ToUpper(rrtype), strings.Join(fields, " ")))
+    }
+
+    return nil, fmt.Errorf("unsupported record type %q", rrtype)
+}
@@ -0,0 +1,278 @@
+// Package docker derives DNS records from the labels of running containers,
+// read from the Docker Engine API over its unix socket.
+//
+// A container opts in with labels:
+//
+//    unifi-dns.name=app.home.lan,www.home.lan   names to publish (required)
+//    unifi-dns.target=10.0.20.5                 IP (A/AAAA) or host name (CNAME)
+//    unifi-dns.device=udm-home                  device ID or name
+//
+// Without a target the container's own IP address is used. Without a device
+// the record goes to the device whose domains contain the name. Records are
+// removed again once the container stops.
+package docker
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/syncer"
+)
+
+const (
+    LabelName   = "unifi-dns.name"
+    LabelTarget = "unifi-dns.target"
+    LabelDevice = "unifi-dns.device"
+)
+
+// Container is the subset of the Engine API container summary that is used.
+type Container struct {
+    ID              string            `json:"Id"`
+    Names           []string          `json:"Names"`
+    Labels          map[string]string `json:"Labels"`
+    NetworkSettings struct {
+        Networks map[string]struct {
+            IPAddress         string `json:"IPAddress"`
+            GlobalIPv6Address string `json:"GlobalIPv6Address"`
+        } `json:"Networks"`
+    } `json:"NetworkSettings"`
+}
+
+// Client talks to the Docker Engine API.
+type Client struct {
+    http *http.Client
+}
+
+// NewClient returns a client for the Engine API listening on the unix socket
+// at socketPath.
+func NewClient(socketPath string) *Client {
+    return &Client{
+        http: &http.Client{
+            Timeout: 10 * time.Second,
+            Transport: &http.Transport{
+                DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+                    var d net.Dialer
+                    return d.DialContext(ctx, "unix", socketPath)
+                },
+            },
+        },
+    }
+}
+
+// RunningContainers lists the running containers that carry a name label.
+func (c *Client) RunningContainers() ([]Container, error) {
+    filters := fmt.Sprintf(`{"status":["running"],"label":[%q]}`, LabelName)
+    req, err := http.NewRequest("GET", "http://docker/containers/json", nil)
+    if err != nil {
+        return nil, err
+    }
+    q := req.URL.Query()
+    q.Set("filters", filters)
+    req.URL.RawQuery = q.Encode()
+
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to list containers: %d", resp.StatusCode)
+    }
+
+    var containers []Container
+    if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+        return nil, err
+    }
+    return containers, nil
+}
+
+type Discovery struct {
+    store    *store.Store
+    syncer   *syncer.Syncer
+    client   *Client
+    interval time.Duration
+}
+
+func NewDiscovery(store *store.Store, syncer *syncer.Syncer, client *Client, interval time.Duration) *Discovery {
+    return &Discovery{
+        store:    store,
+        syncer:   syncer,
+        client:   client,
+        interval: interval,
+    }
+}
+
+// Run polls the running containers until ctx is cancelled.
+func (d *Discovery) Run(ctx context.Context) {
+    log.Printf("Docker: discovering containers every %s", d.interval)
+
+    ticker := time.NewTicker(d.interval)
+    defer ticker.Stop()
+
+    for {
+        if err := d.Sync(); err != nil {
+            log.Printf("Docker: %v", err)
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// Sync reconciles the docker records with the running containers.
+func (d *Discovery) Sync() error {
+    containers, err := d.client.RunningContainers()
+    if err != nil {
+        return err
+    }
+
+    devices, err := d.store.ListDevices()
+    if err != nil {
+        return err
+    }
+
+    desired := Records(containers, devices)
+
+    created, updated, deleted, err := d.store.ReconcileSource(models.SourceDocker, "", desired)
+    if err != nil {
+        return err
+    }
+
+    if created+updated+deleted > 0 {
+        log.Printf("Docker: %d records from %d containers (%d created, %d deleted)",
+            len(desired), len(containers), created, deleted)
+        d.syncer.Trigger()
+    }
+    return nil
+}
+
+// Records maps labelled containers to records. Containers whose labels
+// cannot be resolved to a valid record are logged and skipped so one bad
+// label does not remove every other container's records.
+func Records(containers []Container, devices []*models.UnifiDevice) []*models.DNSRecord {
+    var records []*models.DNSRecord
+    seen := make(map[string]bool)
+
+    for _, c := range containers {
+        names := strings.Split(c.Labels[LabelName], ",")
+        target := strings.TrimSpace(c.Labels[LabelTarget])
+        if target == "" {
+            target = containerIP(c)
+        }
+        if target == "" {
+            log.Printf("Docker: container %s has no %s label and no IP address", containerName(c), LabelTarget)
+            continue
+        }
+
+        for _, name := range names {
+            name = strings.TrimSpace(name)
+            if name == "" {
+                continue
+            }
+
+            device := deviceFor(devices, c.Labels[LabelDevice], name)
+            if device == nil {
+                log.Printf("Docker: container %s: no device for %s", containerName(c), name)
+                continue
+            }
+
+            record := &models.DNSRecord{
+                ID:          uuid.New().String(),
+                Name:        name,
+                RRType:      recordType(target),
+                Value:       target,
+                DeviceID:    device.ID,
+                Enabled:     true,
+                Description: "container " + containerName(c),
+                CreatedBy:   models.SourceDocker,
+                Source:      models.SourceDocker,
+                ReadOnly:    true,
+            }
+            if err := record.Validate(); err != nil {
+                log.Printf("Docker: container %s: %s: %v", containerName(c), name, err)
+                continue
+            }
+
+            if seen[record.Key()] {
+                continue
+            }
+            seen[record.Key()] = true
+            records = append(records, record)
+        }
+    }
+
+    return records
+}
+
+func recordType(target string) string {
+    ip := net.ParseIP(target)
+    switch {
+    case ip == nil:
+        return "CNAME"
+    case ip.To4() != nil:
+        return "A"
+    default:
+        return "AAAA"
+    }
+}
+
+// containerIP returns the IPv4 address of the container on the first of its
+// networks (by name), falling back to IPv6.
+func containerIP(c Container) string {
+    var networks []string
+    for name := range c.NetworkSettings.Networks {
+        networks = append(networks, name)
+    }
+    sort.Strings(networks)
+
+    for _, name := range networks {
+        if ip := c.NetworkSettings.Networks[name].IPAddress; ip != "" {
+            return ip
+        }
+    }
+    for _, name := range networks {
+        if ip := c.NetworkSettings.Networks[name].GlobalIPv6Address; ip != "" {
+            return ip
+        }
+    }
+    return ""
+}
+
+func containerName(c Container) string {
+    if len(c.Names) > 0 {
+        return strings.TrimPrefix(c.Names[0], "/")
+    }
+    if len(c.ID) > 12 {
+        return c.ID[:12]
+    }
+    return c.ID
+}
+
+// deviceFor resolves an explicit device reference, or else the device with
+// the most specific domain containing name.
+func deviceFor(devices []*models.UnifiDevice, ref, name string) *models.UnifiDevice {
+    if ref = strings.TrimSpace(ref); ref != "" {
+        for _, device := range devices {
+            if device.ID == ref || device.Name == ref {
+                return device
+            }
+        }
+        return nil
+    }
+    return models.DeviceForName(devices, name)
+}
@@ -0,0 +1,168 @@
+package docker
+
+import (
+    "encoding/json"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/syncer"
+)
+
+// engine is a fake Docker Engine API serving the running containers on a
+// unix socket.
+type engine struct {
+    mu         sync.Mutex
+    containers []Container
+    filters    string
+}
+
+func (e *engine) set(containers ...Container) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.containers = containers
+}
+
+func (e *engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path != "/containers/json" {
+        http.NotFound(w, r)
+        return
+    }
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.filters = r.URL.Query().Get("filters")
+    json.NewEncoder(w).Encode(e.containers)
+}
+
+// startEngine serves e on a unix socket in a temporary directory. The
+// directory is kept short since socket paths are limited to ~100 bytes.
+func startEngine(t *testing.T, e *engine) *Client {
+    t.Helper()
+    dir, err := os.MkdirTemp("", "docker")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.RemoveAll(dir) })
+
+    socket := filepath.Join(dir, "docker.sock")
+    listener, err := net.Listen("unix", socket)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    server := httptest.NewUnstartedServer(e)
+    server.Listener = listener
+    server.Start()
+    t.Cleanup(server.Close)
+
+    return NewClient(socket)
+}
+
+func container(id string, labels map[string]string, ip string) Container {
+    c := Container{ID: id, Names: []string{"/" + id}, Labels: labels}
+    if ip != "" {
+        c.NetworkSettings.Networks = map[string]struct {
+            IPAddress         string `json:"IPAddress"`
+            GlobalIPv6Address string `json:"GlobalIPv6Address"`
+        }{"bridge": {IPAddress: ip}}
+    }
+    return c
+}
+
+func TestRecords(t *testing.T) {
+    devices := []*models.UnifiDevice{
+        {ID: "home", Name: "udm-home", Domains: []string{"home.lan"}},
+        {ID: "lab", Name: "udm-lab", Domains: []string{"lab.home.lan"}},
+    }
+    containers := []Container{
+        container("web", map[string]string{LabelName: "app.home.lan, www.lab.home.lan"}, "172.17.0.2"),
+        container("v6", map[string]string{LabelName: "v6.home.lan", LabelTarget: "fd00::5"}, ""),
+        container("alias", map[string]string{LabelName: "docs.other.lan", LabelTarget: "web.home.lan", LabelDevice: "udm-home"}, ""),
+        container("noip", map[string]string{LabelName: "noip.home.lan"}, ""),
+        container("nodevice", map[string]string{LabelName: "app.other.lan"}, "172.17.0.3"),
+        container("unknown", map[string]string{LabelName: "x.home.lan", LabelDevice: "missing"}, "172.17.0.4"),
+        container("dup", map[string]string{LabelName: "app.home.lan"}, "172.17.0.2"),
+    }
+
+    type want struct{ rrtype, value, device string }
+    expected := map[string]want{
+        "app.home.lan":     {"A", "172.17.0.2", "home"},
+        "www.lab.home.lan": {"A", "172.17.0.2", "lab"},
+        "v6.home.lan":      {"AAAA", "fd00::5", "home"},
+        "docs.other.lan":   {"CNAME", "web.home.lan", "home"},
+    }
+
+    records := Records(containers, devices)
+    if len(records) != len(expected) {
+        t.Errorf("got %d records, want %d", len(records), len(expected))
+    }
+    for _, r := range records {
+        w, ok := expected[r.Name]
+        if !ok {
+            t.Errorf("unexpected record %s", r.Name)
+            continue
+        }
+        if r.RRType != w.rrtype || r.Value != w.value || r.DeviceID != w.device {
+            t.Errorf("%s = %s %s on %s, want %s %s on %s", r.Name, r.RRType, r.Value, r.DeviceID, w.rrtype, w.value, w.device)
+        }
+        if r.Source != models.SourceDocker || !r.ReadOnly {
+            t.Errorf("%s: source %q, read-only %v", r.Name, r.Source, r.ReadOnly)
+        }
+    }
+}
+
+func TestSyncFollowsContainerStartAndStop(t *testing.T) {
+    s, err := store.NewStore(filepath.Join(t.TempDir(), "test.db"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+
+    creds := &models.UnifiCredentials{ID: "creds", Username: "admin", Password: "secret"}
+    if err := s.CreateCredentials(creds); err != nil {
+        t.Fatal(err)
+    }
+    device := &models.UnifiDevice{ID: "home", Name: "udm-home", Address: "192.0.2.1", Domains: []string{"home.lan"}, Credentials: creds}
+    if err := s.CreateDevice(device); err != nil {
+        t.Fatal(err)
+    }
+
+    e := &engine{}
+    d := NewDiscovery(s, syncer.New(s), startEngine(t, e), 0)
+
+    // Container started.
+    e.set(container("web", map[string]string{LabelName: "app.home.lan"}, "172.17.0.2"))
+    if err := d.Sync(); err != nil {
+        t.Fatalf("Sync: %v", err)
+    }
+    if e.filters != `{"status":["running"],"label":["unifi-dns.name"]}` {
+        t.Errorf("filters = %s", e.filters)
+    }
+
+    records, err := s.ListDNSRecordsBySource(models.SourceDocker)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(records) != 1 || records[0].Name != "app.home.lan" || records[0].Value != "172.17.0.2" {
+        t.Fatalf("records after start = %+v", records)
+    }
+
+    // Container stopped.
+    e.set()
+    if err := d.Sync(); err != nil {
+        t.Fatalf("Sync: %v", err)
+    }
+    records, err = s.ListDNSRecordsBySource(models.SourceDocker)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(records) != 0 {
+        t.Errorf("records after stop = %d, want 0", len(records))
+    }
+}
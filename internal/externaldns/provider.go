@@ -0,0 +1,316 @@
+// Package externaldns implements the external-dns webhook provider protocol
+// so that external-dns running in Kubernetes can manage records on the UniFi
+// devices through this service.
+//
+// Each endpoint is assigned to the device whose domains contain its DNS name
+// (the most specific domain wins). Records created this way are stored with
+// the external-dns source, are read-only in the UI, and are pushed to the
+// controller before the request returns.
+//
+// The webhook has no authentication of its own in external-dns, which
+// expects the provider as a sidecar on localhost. The listener must
+// therefore be a loopback address unless a bearer token is required with
+// RequireToken.
+package externaldns
+
+import (
+    "context"
+    "crypto/subtle"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+
+    "github.com/google/uuid"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/logging"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/syncer"
+)
+
+const mediaType = "application/external.dns.webhook+json;version=1"
+
+// Endpoint mirrors external-dns' endpoint.Endpoint.
+type Endpoint struct {
+    DNSName          string             `json:"dnsName"`
+    Targets          []string           `json:"targets"`
+    RecordType       string             `json:"recordType"`
+    SetIdentifier    string             `json:"setIdentifier,omitempty"`
+    RecordTTL        int64              `json:"recordTTL,omitempty"`
+    Labels           map[string]string  `json:"labels,omitempty"`
+    ProviderSpecific []ProviderSpecific `json:"providerSpecific,omitempty"`
+}
+
+type ProviderSpecific struct {
+    Name  string `json:"name"`
+    Value string `json:"value"`
+}
+
+// Changes mirrors external-dns' plan.Changes.
+type Changes struct {
+    Create    []*Endpoint `json:"Create"`
+    UpdateOld []*Endpoint `json:"UpdateOld"`
+    UpdateNew []*Endpoint `json:"UpdateNew"`
+    Delete    []*Endpoint `json:"Delete"`
+}
+
+// DomainFilter is returned during negotiation to tell external-dns which
+// names this provider is responsible for.
+type DomainFilter struct {
+    Include []string `json:"include,omitempty"`
+    Exclude []string `json:"exclude,omitempty"`
+}
+
+var supportedTypes = map[string]bool{
+    "A":     true,
+    "AAAA":  true,
+    "CNAME": true,
+    "TXT":   true,
+}
+
+type Provider struct {
+    store  *store.Store
+    syncer *syncer.Syncer
+    token  string
+}
+
+func NewProvider(store *store.Store, syncer *syncer.Syncer) *Provider {
+    return &Provider{
+        store:  store,
+        syncer: syncer,
+    }
+}
+
+// RequireToken makes every route except /healthz require token as a bearer
+// token.
+func (p *Provider) RequireToken(token string) {
+    p.token = token
+}
+
+// Handler returns the webhook routes. external-dns expects them on
+// localhost:8888 by default.
+func (p *Provider) Handler() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/", p.authorize(p.Negotiate))
+    mux.HandleFunc("/records", p.authorize(p.Records))
+    mux.HandleFunc("/adjustendpoints", p.authorize(p.AdjustEndpoints))
+    mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+        w.Write([]byte("ok"))
+    })
+    return mux
+}
+
+func (p *Provider) authorize(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if p.token != "" &&
+            subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+p.token)) != 1 {
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            http.Error(w, "Unauthorized", http.StatusUnauthorized)
+            return
+        }
+        next(w, r)
+    }
+}
+
+func (p *Provider) Negotiate(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path != "/" {
+        http.NotFound(w, r)
+        return
+    }
+
+    devices, err := p.store.ListDevices()
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    var filter DomainFilter
+    for _, device := range devices {
+        filter.Include = append(filter.Include, device.Domains...)
+    }
+    sort.Strings(filter.Include)
+
+    writeJSON(w, http.StatusOK, filter)
+}
+
+func (p *Provider) Records(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case "GET":
+        endpoints, err := p.endpoints()
+        if err != nil {
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+        writeJSON(w, http.StatusOK, endpoints)
+
+    case "POST":
+        var changes Changes
+        if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+            http.Error(w, "Invalid request body", http.StatusBadRequest)
+            return
+        }
+
+        if err := p.apply(r.Context(), &changes); err != nil {
+            logging.FromContext(r.Context()).Error("external-dns: failed to apply changes", "error", err)
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// AdjustEndpoints drops record types the controllers cannot hold and
+// normalises names, so external-dns does not keep planning changes that can
+// never converge.
+func (p *Provider) AdjustEndpoints(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var endpoints []*Endpoint
+    if err := json.NewDecoder(r.Body).Decode(&endpoints); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    adjusted := []*Endpoint{}
+    for _, ep := range endpoints {
+        if !supportedTypes[ep.RecordType] {
+            continue
+        }
+        ep.DNSName = strings.TrimSuffix(ep.DNSName, ".")
+        adjusted = append(adjusted, ep)
+    }
+
+    writeJSON(w, http.StatusOK, adjusted)
+}
+
+// endpoints groups the external-dns records by name and type.
+func (p *Provider) endpoints() ([]*Endpoint, error) {
+    records, err := p.store.ListDNSRecordsBySource(models.SourceExternalDNS)
+    if err != nil {
+        return nil, err
+    }
+
+    endpoints := []*Endpoint{}
+    byKey := make(map[string]*Endpoint)
+    for _, record := range records {
+        k := record.Name + "|" + record.RRType
+        ep, ok := byKey[k]
+        if !ok {
+            ep = &Endpoint{DNSName: record.Name, RecordType: record.RRType}
+            byKey[k] = ep
+            endpoints = append(endpoints, ep)
+        }
+        ep.Targets = append(ep.Targets, record.Value)
+    }
+
+    return endpoints, nil
+}
+
+func (p *Provider) apply(ctx context.Context, changes *Changes) error {
+    devices, err := p.store.ListDevices()
+    if err != nil {
+        return err
+    }
+
+    existing, err := p.store.ListDNSRecordsBySource(models.SourceExternalDNS)
+    if err != nil {
+        return err
+    }
+
+    // Build and validate every new record first so that a bad endpoint
+    // rejects the whole batch; the batch is then stored in one transaction.
+    // Pushing to the controllers happens afterwards and is retried by the
+    // next sync if it fails.
+    var created []*models.DNSRecord
+    for _, ep := range append(changes.Create, changes.UpdateNew...) {
+        device := models.DeviceForName(devices, ep.DNSName)
+        if device == nil {
+            return fmt.Errorf("no device serves %s", ep.DNSName)
+        }
+
+        for _, target := range ep.Targets {
+            record := &models.DNSRecord{
+                ID:        uuid.New().String(),
+                Name:      ep.DNSName,
+                RRType:    ep.RecordType,
+                Value:     target,
+                DeviceID:  device.ID,
+                Enabled:   true,
+                CreatedBy: models.SourceExternalDNS,
+                Source:    models.SourceExternalDNS,
+                ReadOnly:  true,
+            }
+            if err := record.Validate(); err != nil {
+                return fmt.Errorf("%s %s: %w", ep.RecordType, ep.DNSName, err)
+            }
+            created = append(created, record)
+        }
+    }
+
+    touched := make(map[string]bool)
+    deleted := make(map[string]bool)
+    var deleteIDs []string
+
+    for _, ep := range append(changes.Delete, changes.UpdateOld...) {
+        name := strings.TrimSuffix(ep.DNSName, ".")
+        for _, record := range existing {
+            if !strings.EqualFold(record.Name, name) || record.RRType != ep.RecordType || deleted[record.ID] {
+                continue
+            }
+            deleted[record.ID] = true
+            deleteIDs = append(deleteIDs, record.ID)
+            touched[record.DeviceID] = true
+        }
+    }
+
+    // external-dns retries a batch that failed, so records that are already
+    // stored, and not being deleted, are kept rather than added twice. Their
+    // devices are still synced in case the failure was the push.
+    stored := make(map[string]bool)
+    for _, record := range existing {
+        if !deleted[record.ID] {
+            stored[recordKey(record)] = true
+        }
+    }
+    var adds []*models.DNSRecord
+    for _, record := range created {
+        touched[record.DeviceID] = true
+        if key := recordKey(record); !stored[key] {
+            stored[key] = true
+            adds = append(adds, record)
+        }
+    }
+
+    if err := p.store.ReplaceDNSRecords(deleteIDs, adds); err != nil {
+        return err
+    }
+
+    for deviceID := range touched {
+        if _, err := p.syncer.SyncDevice(ctx, deviceID); err != nil {
+            return fmt.Errorf("sync device %s: %w", deviceID, err)
+        }
+    }
+
+    return nil
+}
+
+// recordKey identifies a record by what it serves on which device.
+func recordKey(r *models.DNSRecord) string {
+    return r.DeviceID + "|" + strings.ToLower(r.Name) + "|" + r.RRType + "|" + r.Value
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", mediaType)
+    w.Header().Set("Vary", "Content-Type")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,268 @@
+// Package gitops keeps dns_records in line with a directory of YAML files,
+// typically a git checkout, so that the repository is the source of truth
+// for the records it declares.
+//
+// Each file names a device (by ID or name) and the records it should have:
+//
+//    device: udm-home
+//    records:
+//      - name: printer.home.lan
+//        type: A
+//        value: 10.0.20.15
+//        description: Office printer
+//      - name: nas.home.lan
+//        type: CNAME
+//        value: storage.home.lan
+//        enabled: false
+package gitops
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io/fs"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+    "gopkg.in/yaml.v3"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/syncer"
+)
+
+// File is the on-disk format of a records file.
+type File struct {
+    Device  string   `yaml:"device"`
+    Records []Record `yaml:"records"`
+}
+
+type Record struct {
+    Name        string `yaml:"name"`
+    Type        string `yaml:"type"`
+    Value       string `yaml:"value"`
+    Description string `yaml:"description"`
+    Enabled     *bool  `yaml:"enabled"`
+}
+
+// ValidationError lists every problem found in the directory. Nothing is
+// applied when the directory does not validate.
+type ValidationError struct {
+    Problems []string
+}
+
+func (e *ValidationError) Error() string {
+    return fmt.Sprintf("%d invalid entries: %s", len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+type Watcher struct {
+    store    *store.Store
+    syncer   *syncer.Syncer
+    dir      string
+    interval time.Duration
+
+    fingerprint string
+}
+
+func NewWatcher(store *store.Store, syncer *syncer.Syncer, dir string, interval time.Duration) *Watcher {
+    return &Watcher{
+        store:    store,
+        syncer:   syncer,
+        dir:      dir,
+        interval: interval,
+    }
+}
+
+// Run polls the directory until ctx is cancelled, reconciling whenever the
+// set of YAML files or their contents change.
+func (w *Watcher) Run(ctx context.Context) {
+    log.Printf("GitOps: watching %s every %s", w.dir, w.interval)
+
+    ticker := time.NewTicker(w.interval)
+    defer ticker.Stop()
+
+    for {
+        if err := w.poll(); err != nil {
+            log.Printf("GitOps: %v", err)
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+func (w *Watcher) poll() error {
+    fingerprint, err := w.scan()
+    if err != nil {
+        return err
+    }
+    if fingerprint == w.fingerprint {
+        return nil
+    }
+
+    if err := w.Sync(); err != nil {
+        return err
+    }
+
+    // Only remember the state once it has been applied, so that an invalid
+    // change is retried (and reported) until it is fixed.
+    w.fingerprint = fingerprint
+    return nil
+}
+
+// scan returns a digest of the names, sizes and modification times of the
+// YAML files in the directory.
+func (w *Watcher) scan() (string, error) {
+    files, err := yamlFiles(w.dir)
+    if err != nil {
+        return "", err
+    }
+
+    h := sha256.New()
+    for _, path := range files {
+        info, err := os.Stat(path)
+        if err != nil {
+            return "", err
+        }
+        fmt.Fprintf(h, "%s\x00%d\x00%d\n", path, info.Size(), info.ModTime().UnixNano())
+    }
+
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Sync loads and validates the directory and reconciles the result into the
+// store.
+func (w *Watcher) Sync() error {
+    devices, err := w.store.ListDevices()
+    if err != nil {
+        return err
+    }
+
+    desired, err := Load(w.dir, devices)
+    if err != nil {
+        return err
+    }
+
+    created, updated, deleted, err := w.store.ReconcileSource(models.SourceGitOps, "", desired)
+    if err != nil {
+        return err
+    }
+
+    log.Printf("GitOps: applied %d records (%d created, %d updated, %d deleted)",
+        len(desired), created, updated, deleted)
+
+    if created+updated+deleted > 0 {
+        w.syncer.Trigger()
+    }
+    return nil
+}
+
+// Load reads every YAML file in dir and returns the records they declare.
+// Devices may be referenced by ID or by name.
+func Load(dir string, devices []*models.UnifiDevice) ([]*models.DNSRecord, error) {
+    files, err := yamlFiles(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    byRef := make(map[string]*models.UnifiDevice)
+    for _, device := range devices {
+        byRef[device.ID] = device
+        byRef[device.Name] = device
+    }
+
+    var problems []string
+    var records []*models.DNSRecord
+    seen := make(map[string]string)
+
+    for _, path := range files {
+        rel, _ := filepath.Rel(dir, path)
+
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, err
+        }
+
+        var file File
+        if err := yaml.Unmarshal(data, &file); err != nil {
+            problems = append(problems, fmt.Sprintf("%s: %v", rel, err))
+            continue
+        }
+
+        device, ok := byRef[file.Device]
+        if !ok {
+            problems = append(problems, fmt.Sprintf("%s: unknown device %q", rel, file.Device))
+            continue
+        }
+
+        for i, entry := range file.Records {
+            record := &models.DNSRecord{
+                ID:          uuid.New().String(),
+                Name:        entry.Name,
+                RRType:      entry.Type,
+                Value:       entry.Value,
+                DeviceID:    device.ID,
+                Enabled:     entry.Enabled == nil || *entry.Enabled,
+                Description: entry.Description,
+                CreatedBy:   models.SourceGitOps,
+                Source:      models.SourceGitOps,
+                ReadOnly:    true,
+            }
+
+            where := fmt.Sprintf("%s: record %d", rel, i+1)
+            if err := record.Validate(); err != nil {
+                problems = append(problems, fmt.Sprintf("%s: %v", where, err))
+                continue
+            }
+
+            key := record.Key()
+            if first, dup := seen[key]; dup {
+                problems = append(problems, fmt.Sprintf("%s: duplicates %s", where, first))
+                continue
+            }
+            seen[key] = where
+
+            records = append(records, record)
+        }
+    }
+
+    if len(problems) > 0 {
+        return nil, &ValidationError{Problems: problems}
+    }
+    return records, nil
+}
+
+// yamlFiles lists the YAML files below dir in a stable order, skipping
+// hidden directories such as .git.
+func yamlFiles(dir string) ([]string, error) {
+    var files []string
+    err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if d.IsDir() {
+            if path != dir && strings.HasPrefix(d.Name(), ".") {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+
+        switch strings.ToLower(filepath.Ext(path)) {
+        case ".yaml", ".yml":
+            files = append(files, path)
+        }
+        return nil
+    })
+
+    sort.Strings(files)
+    return files, err
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/logging"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+)
+
+type accessKey struct{}
+
+var errUnauthenticated = errors.New("unauthenticated")
+
+// tokenTouchInterval limits how often a token's last-used time is written.
+const tokenTouchInterval = time.Minute
+
+// Access is what the signed in user may do: their role on every device,
+// raised for particular devices or groups by their grants, and limited by
+// the token's scopes when the request used an API token.
+type Access struct {
+    User   *models.User
+    Token  *models.APIToken
+    grants []*models.Grant
+}
+
+// Role returns the user's effective role on device.
+func (a *Access) Role(device *models.UnifiDevice) string {
+    role := a.User.Role
+    for _, grant := range a.grants {
+        if grant.Applies(device) && models.RoleIncludes(grant.Role, role) {
+            role = grant.Role
+        }
+    }
+    return a.limit(role)
+}
+
+func (a *Access) Can(device *models.UnifiDevice, role string) bool {
+    return models.RoleIncludes(a.Role(device), role)
+}
+
+// anywhere reports whether the user holds role on at least one device, or
+// could once a matching device exists.
+func (a *Access) anywhere(role string) bool {
+    best := a.User.Role
+    for _, grant := range a.grants {
+        if models.RoleIncludes(grant.Role, best) {
+            best = grant.Role
+        }
+    }
+    return models.RoleIncludes(a.limit(best), role)
+}
+
+func (a *Access) limit(role string) string {
+    if a.Token != nil && !models.RoleIncludes(a.Token.Role(), role) {
+        return a.Token.Role()
+    }
+    return role
+}
+
+func accessFrom(r *http.Request) *Access {
+    access, _ := r.Context().Value(accessKey{}).(*Access)
+    return access
+}
+
+// RequireRole rejects requests from users that do not hold role on any
+// device, and makes the user's Access available to the handler. Requests
+// are authenticated by session cookie or by an "Authorization: Bearer" API
+// token. Handlers that act on a particular device check it again with
+// authorizeDevice.
+func (h *Handler) RequireRole(role string) func(http.HandlerFunc) http.HandlerFunc {
+    return func(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            access, err := h.authenticate(r)
+            if err == errUnauthenticated || err == store.ErrNotFound {
+                if r.Header.Get("Authorization") != "" {
+                    w.Header().Set("WWW-Authenticate", `Bearer realm="unifi-dns-sync"`)
+                }
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+            }
+            if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+            }
+
+            logging.Add(r.Context(), "user", access.User.Username)
+            if !access.anywhere(role) {
+                http.Error(w, "Forbidden", http.StatusForbidden)
+                return
+            }
+
+            next(w, r.WithContext(context.WithValue(r.Context(), accessKey{}, access)))
+        }
+    }
+}
+
+func (h *Handler) authenticate(r *http.Request) (*Access, error) {
+    if header := r.Header.Get("Authorization"); header != "" {
+        return h.tokenAccess(header)
+    }
+
+    session := h.sessionManager.GetSessionFromRequest(r)
+    if session == nil {
+        return nil, errUnauthenticated
+    }
+    return h.access(session.UserID)
+}
+
+func (h *Handler) tokenAccess(header string) (*Access, error) {
+    scheme, secret, ok := strings.Cut(header, " ")
+    if !ok || !strings.EqualFold(scheme, "Bearer") {
+        return nil, errUnauthenticated
+    }
+
+    token, err := h.store.GetAPITokenByHash(hashToken(strings.TrimSpace(secret)))
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now()
+    if token.Expired(now) {
+        return nil, errUnauthenticated
+    }
+
+    access, err := h.access(token.UserID)
+    if err != nil {
+        return nil, err
+    }
+    access.Token = token
+
+    if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > tokenTouchInterval {
+        if err := h.store.TouchAPIToken(token.ID, now); err != nil {
+            log.Printf("Failed to record use of API token %s: %v", token.ID, err)
+        }
+    }
+
+    return access, nil
+}
+
+func (h *Handler) access(userID string) (*Access, error) {
+    user, err := h.store.GetUserByID(userID)
+    if err != nil {
+        return nil, err
+    }
+    if user.Disabled {
+        return nil, store.ErrNotFound
+    }
+
+    grants, err := h.store.ListGrants(user.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    return &Access{User: user, grants: grants}, nil
+}
+
+// authorizeDevice loads a device and checks that the user holds role on it,
+// replying with an error and returning false otherwise.
+func (h *Handler) authorizeDevice(w http.ResponseWriter, r *http.Request, deviceID, role string) (*models.UnifiDevice, bool) {
+    device, err := h.store.GetDevice(deviceID)
+    if err == store.ErrNotFound {
+        http.Error(w, "Unknown device", http.StatusBadRequest)
+        return nil, false
+    }
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return nil, false
+    }
+
+    logging.Add(r.Context(), "device_id", device.ID)
+    if !accessFrom(r).Can(device, role) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return nil, false
+    }
+
+    return device, true
+}
+
+// Grants lists grants (GET, optionally for ?user_id=), creates one (POST) or
+// removes one (DELETE ?id=). Only admins may use it.
+func (h *Handler) Grants(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case "GET":
+        grants, err := h.store.ListGrants(r.URL.Query().Get("user_id"))
+        if err != nil {
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+
+        if grants == nil {
+            grants = []*models.Grant{}
+        }
+        json.NewEncoder(w).Encode(grants)
+
+    case "POST":
+        var grant models.Grant
+        if err := json.NewDecoder(r.Body).Decode(&grant); err != nil {
+            http.Error(w, "Invalid request body", http.StatusBadRequest)
+            return
+        }
+
+        if err := grant.Validate(); err != nil {
+            badRequest(w, err)
+            return
+        }
+
+        if _, err := h.store.GetUserByID(grant.UserID); err != nil {
+            invalidField(w, "user_id", "Unknown user")
+            return
+        }
+        if grant.DeviceID != "" {
+            if _, err := h.store.GetDevice(grant.DeviceID); err != nil {
+                invalidField(w, "device_id", "Unknown device")
+                return
+            }
+        }
+
+        grant.ID = uuid.New().String()
+        grant.CreatedBy = accessFrom(r).User.ID
+
+        if err := h.store.CreateGrant(&grant); err != nil {
+            http.Error(w, "Failed to save grant", http.StatusInternalServerError)
+            return
+        }
+
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(grant)
+
+    case "DELETE":
+        err := h.store.DeleteGrant(r.URL.Query().Get("id"))
+        if err == store.ErrNotFound {
+            http.Error(w, "Grant not found", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            http.Error(w, "Failed to delete grant", http.StatusInternalServerError)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
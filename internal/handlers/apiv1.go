@@ -0,0 +1,284 @@
+package handlers
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strings"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/ptr"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/twofactor"
+)
+
+const apiV1Prefix = "/api/v1"
+
+// APIError is the body of every error reply under /api/v1. Code is derived
+// from the status, such as "not_found", or is "validation_failed" when
+// Fields lists the request fields at fault.
+type APIError struct {
+    Code      string              `json:"code"`
+    Message   string              `json:"message"`
+    Fields    []models.FieldError `json:"fields,omitempty"`
+    RequestID string              `json:"request_id,omitempty"`
+}
+
+// errorWriter holds back the plain text replies of http.Error and writes
+// them as an APIError instead, so the handlers shared with the unversioned
+// API, which the web UI reads as text, stay as they are.
+type errorWriter struct {
+    http.ResponseWriter
+    status  int
+    message bytes.Buffer
+    fields  []models.FieldError
+}
+
+func (w *errorWriter) WriteHeader(status int) {
+    if status >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+        w.status = status
+        return
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorWriter) Write(b []byte) (int, error) {
+    if w.status != 0 {
+        return w.message.Write(b)
+    }
+    return w.ResponseWriter.Write(b)
+}
+
+func (w *errorWriter) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+// APIErrorMiddleware replies to errors with an APIError body.
+func APIErrorMiddleware(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        ew := &errorWriter{ResponseWriter: w}
+        next.ServeHTTP(ew, r)
+
+        if ew.status != 0 {
+            writeAPIError(w, r, ew.status, strings.TrimSpace(ew.message.String()), ew.fields)
+        }
+    }
+}
+
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, message string, fields []models.FieldError) {
+    code := strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+    if len(fields) > 0 {
+        code = "validation_failed"
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(APIError{
+        Code:      code,
+        Message:   message,
+        Fields:    fields,
+        RequestID: requestID(r),
+    })
+}
+
+// badRequest replies 400 with err. A models.FieldError in err is also
+// listed in the /api/v1 error body.
+func badRequest(w http.ResponseWriter, err error) {
+    var fe *models.FieldError
+    if errors.As(err, &fe) {
+        for rw := w; rw != nil; {
+            if ew, ok := rw.(*errorWriter); ok {
+                ew.fields = append(ew.fields, *fe)
+                break
+            }
+            u, ok := rw.(interface{ Unwrap() http.ResponseWriter })
+            if !ok {
+                break
+            }
+            rw = u.Unwrap()
+        }
+    }
+    http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// invalidField replies 400 about one field of the request body.
+func invalidField(w http.ResponseWriter, field, message string) {
+    badRequest(w, &models.FieldError{Field: field, Message: message})
+}
+
+// allowMethods replies 405 to requests with any other method.
+func allowMethods(methods ...string) func(http.HandlerFunc) http.HandlerFunc {
+    allow := strings.Join(methods, ", ")
+    return func(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            for _, method := range methods {
+                if r.Method == method {
+                    next.ServeHTTP(w, r)
+                    return
+                }
+            }
+            w.Header().Set("Allow", allow)
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+    }
+}
+
+// apiRoute is an endpoint of /api/v1. The handlers are the ones behind the
+// unversioned /api routes.
+type apiRoute struct {
+    path       string
+    role       string
+    handler    http.HandlerFunc
+    operations []apiOperation
+}
+
+// apiOperation is one method of a route. It decides which methods are
+// routed and describes them in the OpenAPI document.
+type apiOperation struct {
+    method  string
+    summary string
+    query   []string
+    // request and response are values of the body types, or nil for none.
+    request  interface{}
+    status   int
+    response interface{}
+}
+
+func (h *Handler) apiRoutes() []apiRoute {
+    return []apiRoute{
+        {"/devices", models.RoleViewer, h.GetDevices, []apiOperation{
+            {method: "GET", summary: "List devices", response: []models.UnifiDevice{}},
+        }},
+        {"/devices/add", models.RoleAdmin, h.AddDevice, []apiOperation{
+            {method: "POST", summary: "Add a device", request: models.UnifiDevice{}, status: http.StatusCreated, response: models.UnifiDevice{}},
+        }},
+        {"/devices/tls", models.RoleAdmin, h.DeviceTLS, []apiOperation{
+            {method: "GET", summary: "Show a device's certificate verification and the certificate its controller presents", query: []string{"id"}, response: map[string]interface{}{}},
+            {method: "PUT", summary: "Change how a device's controller certificate is verified", request: deviceTLSRequest{}, response: models.UnifiDevice{}},
+        }},
+        {"/devices/tls/repin", models.RoleAdmin, h.RepinDevice, []apiOperation{
+            {method: "POST", summary: "Pin the certificate a controller presents now", request: repinRequest{}, status: http.StatusNoContent},
+        }},
+        {"/dns", models.RoleViewer, h.DNSRecords, []apiOperation{
+            {method: "GET", summary: "List a device's records", query: []string{"device_id"}, response: []models.DNSRecord{}},
+            {method: "DELETE", summary: "Delete a record", query: []string{"record_id"}, status: http.StatusNoContent},
+        }},
+        {"/dns/create", models.RoleOperator, h.CreateDNSRecord, []apiOperation{
+            {method: "POST", summary: "Create a record", request: models.DNSRecord{}, status: http.StatusCreated, response: models.DNSRecord{}},
+        }},
+        {"/dns/update", models.RoleOperator, h.UpdateDNSRecord, []apiOperation{
+            {method: "POST", summary: "Update a record", request: models.DNSRecord{}, response: models.DNSRecord{}},
+        }},
+        {"/dns/verify", models.RoleOperator, h.VerifyDNSRecords, []apiOperation{
+            {method: "POST", summary: "Check that a device's resolver answers with its records", query: []string{"device_id"}, response: []models.RecordCheck{}},
+        }},
+        {"/dns/ptr-conflicts", models.RoleViewer, h.PTRConflicts, []apiOperation{
+            {method: "GET", summary: "List addresses claimed by more than one name", response: []ptr.Conflict{}},
+        }},
+        {"/grants", models.RoleAdmin, h.Grants, []apiOperation{
+            {method: "GET", summary: "List grants", query: []string{"user_id"}, response: []models.Grant{}},
+            {method: "POST", summary: "Grant a role on a device or group", request: models.Grant{}, status: http.StatusCreated, response: models.Grant{}},
+            {method: "DELETE", summary: "Remove a grant", query: []string{"id"}, status: http.StatusNoContent},
+        }},
+        {"/users", models.RoleAdmin, h.Users, []apiOperation{
+            {method: "GET", summary: "List users", response: []models.User{}},
+            {method: "DELETE", summary: "Delete a user", query: []string{"id"}, status: http.StatusNoContent},
+        }},
+        {"/users/create", models.RoleAdmin, h.CreateUser, []apiOperation{
+            {method: "POST", summary: "Create a user", request: createUserRequest{}, status: http.StatusCreated, response: models.User{}},
+        }},
+        {"/users/update", models.RoleAdmin, h.UpdateUser, []apiOperation{
+            {method: "POST", summary: "Change a user's role, disable them or require two-factor authentication", request: updateUserRequest{}, response: models.User{}},
+        }},
+        {"/users/reset-password", models.RoleAdmin, h.ResetPassword, []apiOperation{
+            {method: "POST", summary: "Set a user's password and sign them out", request: resetPasswordRequest{}, status: http.StatusNoContent},
+        }},
+        {"/users/reset-2fa", models.RoleAdmin, h.ResetTwoFactor, []apiOperation{
+            {method: "POST", summary: "Turn off a user's two-factor authentication", request: userRequest{}, status: http.StatusNoContent},
+        }},
+        {"/users/unlock", models.RoleAdmin, h.UnlockUser, []apiOperation{
+            {method: "POST", summary: "Lift a lockout from failed logins", request: userRequest{}, status: http.StatusNoContent},
+        }},
+        {"/account/password", models.RoleViewer, h.ChangePassword, []apiOperation{
+            {method: "POST", summary: "Change your password", request: changePasswordRequest{}, status: http.StatusNoContent},
+        }},
+        {"/account/2fa", models.RoleViewer, h.TwoFactorStatus, []apiOperation{
+            {method: "GET", summary: "Show your two-factor settings", response: twoFactorStatus{}},
+        }},
+        {"/account/2fa/setup", models.RoleViewer, h.TwoFactorSetup, []apiOperation{
+            {method: "POST", summary: "Start two-factor enrollment", response: twofactor.Enrollment{}},
+        }},
+        {"/account/2fa/enable", models.RoleViewer, h.TwoFactorEnable, []apiOperation{
+            {method: "POST", summary: "Confirm two-factor enrollment", request: codeRequest{}, response: recoveryCodes{}},
+        }},
+        {"/account/2fa/disable", models.RoleViewer, h.TwoFactorDisable, []apiOperation{
+            {method: "POST", summary: "Turn off two-factor authentication", request: passwordRequest{}, status: http.StatusNoContent},
+        }},
+        {"/account/2fa/recovery-codes", models.RoleViewer, h.TwoFactorRecoveryCodes, []apiOperation{
+            {method: "POST", summary: "Replace your recovery codes", request: codeRequest{}, response: recoveryCodes{}},
+        }},
+        {"/tokens", models.RoleViewer, h.APITokens, []apiOperation{
+            {method: "GET", summary: "List your API tokens, or every token for admins with all=true", query: []string{"all"}, response: []models.APIToken{}},
+            {method: "DELETE", summary: "Revoke an API token", query: []string{"id"}, status: http.StatusNoContent},
+        }},
+        {"/tokens/create", models.RoleViewer, h.CreateAPIToken, []apiOperation{
+            {method: "POST", summary: "Create an API token", request: createTokenRequest{}, status: http.StatusCreated, response: createdToken{}},
+        }},
+        {"/sessions", models.RoleViewer, h.Sessions, []apiOperation{
+            {method: "GET", summary: "List your sessions, or every session for admins with all=true", query: []string{"all"}, response: []sessionInfo{}},
+            {method: "DELETE", summary: "Sign a session out", query: []string{"id"}, status: http.StatusNoContent},
+        }},
+        {"/sessions/logout-all", models.RoleViewer, h.LogoutAllSessions, []apiOperation{
+            {method: "POST", summary: "Sign out your other sessions", status: http.StatusNoContent},
+        }},
+        {"/audit", models.RoleAdmin, h.AuditLog, []apiOperation{
+            {method: "GET", summary: "List recent audit entries", query: []string{"limit"}, response: []models.AuditEntry{}},
+        }},
+    }
+}
+
+// RegisterAPIv1 serves the API under /api/v1, with APIError bodies, 405 for
+// methods a route does not support and the OpenAPI document at
+// /api/v1/openapi.json. version is the API document's version.
+func (h *Handler) RegisterAPIv1(mux *http.ServeMux, version string, cors func(http.HandlerFunc) http.HandlerFunc) {
+    routes := h.apiRoutes()
+    for _, route := range routes {
+        var methods []string
+        for _, op := range route.operations {
+            methods = append(methods, op.method)
+        }
+
+        mux.HandleFunc(apiV1Prefix+route.path, Chain(route.handler,
+            h.RequireRole(route.role),
+            CSRFMiddleware,
+            allowMethods(methods...),
+            LoggingMiddleware,
+            RecoveryMiddleware,
+            APIErrorMiddleware,
+            JSONMiddleware,
+            cors,
+        ))
+    }
+
+    doc := openAPIDocument(version, routes)
+    mux.HandleFunc(apiV1Prefix+"/openapi.json", Chain(func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(doc)
+    },
+        allowMethods("GET"),
+        LoggingMiddleware,
+        RecoveryMiddleware,
+        APIErrorMiddleware,
+        JSONMiddleware,
+        cors,
+    ))
+
+    mux.HandleFunc(apiV1Prefix+"/", Chain(func(w http.ResponseWriter, r *http.Request) {
+        http.Error(w, "Not found", http.StatusNotFound)
+    },
+        LoggingMiddleware,
+        RecoveryMiddleware,
+        APIErrorMiddleware,
+        JSONMiddleware,
+        cors,
+    ))
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/api"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+)
+
+// validateDeviceTLS checks a device's TLS settings, defaulting to pinning.
+func validateDeviceTLS(device *models.UnifiDevice) error {
+    if device.TLSVerify == "" {
+        device.TLSVerify = models.TLSVerifyPin
+    }
+    if !models.ValidTLSVerify(device.TLSVerify) {
+        return &models.FieldError{Field: "tls_verify", Message: fmt.Sprintf("tls_verify must be %s, %s or %s",
+            models.TLSVerifySystem, models.TLSVerifyCA, models.TLSVerifyPin)}
+    }
+    if device.TLSVerify == models.TLSVerifyCA {
+        if _, err := api.ParseCABundle(device.TLSCA); err != nil {
+            return &models.FieldError{Field: "tls_ca", Message: err.Error()}
+        }
+    } else {
+        device.TLSCA = ""
+    }
+    return nil
+}
+
+type deviceTLSRequest struct {
+    ID        string `json:"id"`
+    TLSVerify string `json:"tls_verify"`
+    TLSCA     string `json:"tls_ca"`
+}
+
+// DeviceTLS shows (GET ?id=) or changes (PUT) how a device's controller
+// certificate is verified. GET also connects to the controller and reports
+// the certificate it presents now, so a changed pin can be checked before
+// re-pinning.
+func (h *Handler) DeviceTLS(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case "GET":
+        device, ok := h.deviceByID(w, r.URL.Query().Get("id"))
+        if !ok {
+            return
+        }
+
+        status := map[string]interface{}{
+            "tls_verify":  device.TLSVerify,
+            "tls_ca":      device.TLSCA,
+            "fingerprint": device.TLSFingerprint,
+        }
+        presented, err := api.FetchFingerprint(r.Context(), device.Address)
+        if err != nil {
+            status["error"] = err.Error()
+        } else {
+            status["presented"] = presented
+            status["matches"] = presented == device.TLSFingerprint
+        }
+        json.NewEncoder(w).Encode(status)
+
+    case "PUT":
+        var req deviceTLSRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(w, "Invalid request body", http.StatusBadRequest)
+            return
+        }
+
+        device, ok := h.deviceByID(w, req.ID)
+        if !ok {
+            return
+        }
+        device.TLSVerify, device.TLSCA = req.TLSVerify, req.TLSCA
+        if err := validateDeviceTLS(device); err != nil {
+            badRequest(w, err)
+            return
+        }
+
+        if err := h.store.UpdateDevice(device); err != nil {
+            http.Error(w, "Failed to save device", http.StatusInternalServerError)
+            return
+        }
+        h.syncer.Trigger()
+        json.NewEncoder(w).Encode(device)
+
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+type repinRequest struct {
+    ID          string `json:"id"`
+    Fingerprint string `json:"fingerprint"`
+}
+
+// RepinDevice pins the certificate a controller presents now, after its
+// certificate changed (POST {"id", "fingerprint"}). The fingerprint must be
+// the one GET /api/devices/tls reported, so the admin confirms what is
+// trusted rather than whatever answers at the time.
+func (h *Handler) RepinDevice(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req repinRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    device, ok := h.deviceByID(w, req.ID)
+    if !ok {
+        return
+    }
+    if device.TLSVerify != models.TLSVerifyPin {
+        http.Error(w, "Device does not use certificate pinning", http.StatusBadRequest)
+        return
+    }
+
+    presented, err := api.FetchFingerprint(r.Context(), device.Address)
+    if err != nil {
+        http.Error(w, "Failed to reach controller: "+err.Error(), http.StatusBadGateway)
+        return
+    }
+    if req.Fingerprint != presented {
+        http.Error(w, "The controller presents "+presented+", not the confirmed fingerprint", http.StatusConflict)
+        return
+    }
+
+    if err := h.store.SetDeviceFingerprint(device.ID, presented); err != nil {
+        http.Error(w, "Failed to save device", http.StatusInternalServerError)
+        return
+    }
+
+    h.audit(r, models.AuditCertificatePinned, accessFrom(r).User.Username,
+        fmt.Sprintf("device %s: %s (was %s)", device.Name, presented, device.TLSFingerprint))
+    h.syncer.Trigger()
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// deviceByID loads a device, replying with an error if that fails.
+func (h *Handler) deviceByID(w http.ResponseWriter, id string) (*models.UnifiDevice, bool) {
+    device, err := h.store.GetDevice(id)
+    if errors.Is(err, store.ErrNotFound) {
+        http.Error(w, "Device not found", http.StatusNotFound)
+        return nil, false
+    }
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return nil, false
+    }
+    return device, true
+}
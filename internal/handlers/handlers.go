@@ -1,16 +1,23 @@
 package handlers
 
 import (
+    "crypto/subtle"
     "encoding/json"
     "html/template"
+    "log"
     "net/http"
     "path/filepath"
+    "strings"
+    "sync"
 
     "github.com/google/uuid"
 
     "github.com/jlengelbrecht/unifi-dns-sync/internal/api"
     "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/sso"
     "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/syncer"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/verify"
 )
 
 type Handler struct {
@@ -18,9 +25,19 @@ type Handler struct {
     store         *store.Store
     sessionManager *SessionManager
     clients       map[string]*api.UnifiClient
+    syncer        *syncer.Syncer
+    verifier      *verify.Verifier
+    sso           *sso.Provider
+    challenges    *challengeStore
+    throttle      *loginThrottle
+
+    setupMu    sync.Mutex
+    setupToken string
 }
 
-func NewHandler(templatesDir string, store *store.Store) (*Handler, error) {
+// NewHandler returns the web handler. sso may be nil when single sign-on is
+// not configured.
+func NewHandler(templatesDir string, store *store.Store, sessions *SessionManager, syncer *syncer.Syncer, verifier *verify.Verifier, sso *sso.Provider) (*Handler, error) {
     tmpl, err := template.ParseGlob(filepath.Join(templatesDir, "*.html"))
     if err != nil {
         return nil, err
@@ -29,8 +46,13 @@ func NewHandler(templatesDir string, store *store.Store) (*Handler, error) {
     return &Handler{
         templates:      tmpl,
         store:         store,
-        sessionManager: NewSessionManager(),
+        sessionManager: sessions,
         clients:       make(map[string]*api.UnifiClient),
+        syncer:        syncer,
+        verifier:      verifier,
+        sso:           sso,
+        challenges:    newChallengeStore(),
+        throttle:      newLoginThrottle(),
     }, nil
 }
 
@@ -84,6 +106,12 @@ func (h *Handler) Index(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    user, err := h.store.GetUserByID(session.UserID)
+    if err != nil || user.Disabled {
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
+
     devices, err := h.store.ListDevices()
     if err != nil {
         http.Error(w, "Server error", http.StatusInternalServerError)
@@ -91,15 +119,31 @@ func (h *Handler) Index(w http.ResponseWriter, r *http.Request) {
     }
 
     data := struct {
-        Devices []*models.UnifiDevice
+        Devices   []*models.UnifiDevice
+        User      *models.User
+        CSRFToken string
     }{
-        Devices: devices,
+        Devices:   devices,
+        User:      user,
+        CSRFToken: csrfToken(r),
     }
 
     h.templates.ExecuteTemplate(w, "index.html", data)
 }
 
+// RequireSetupToken sets the token the setup page asks for before it
+// creates the first admin. Without one, setup is refused.
+func (h *Handler) RequireSetupToken(token string) {
+    h.setupMu.Lock()
+    defer h.setupMu.Unlock()
+    h.setupToken = token
+}
+
 func (h *Handler) Setup(w http.ResponseWriter, r *http.Request) {
+    // Serialize setup so that two requests cannot both create an admin.
+    h.setupMu.Lock()
+    defer h.setupMu.Unlock()
+
     config, err := h.store.GetAppConfig()
     if err != nil {
         http.Error(w, "Server error", http.StatusInternalServerError)
@@ -111,8 +155,13 @@ func (h *Handler) Setup(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    data := map[string]interface{}{
+        "CSRFToken":  csrfToken(r),
+        "SetupToken": r.URL.Query().Get("token"),
+    }
+
     if r.Method == "GET" {
-        h.templates.ExecuteTemplate(w, "setup.html", nil)
+        h.templates.ExecuteTemplate(w, "setup.html", data)
         return
     }
 
@@ -121,11 +170,29 @@ func (h *Handler) Setup(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    token := r.FormValue("setup_token")
+    if h.setupToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.setupToken)) != 1 {
+        h.audit(r, models.AuditSetupDenied, r.FormValue("username"), "")
+        data["Error"] = "Invalid setup token, see the server log"
+        w.WriteHeader(http.StatusForbidden)
+        h.templates.ExecuteTemplate(w, "setup.html", data)
+        return
+    }
+
+    username := strings.TrimSpace(r.FormValue("username"))
+    if username == "" || len(r.FormValue("password")) < minPasswordLength {
+        data["Error"] = "A username and a password of at least 8 characters are required"
+        w.WriteHeader(http.StatusBadRequest)
+        h.templates.ExecuteTemplate(w, "setup.html", data)
+        return
+    }
+
     // Create admin user
     adminUser := &models.User{
         ID:       uuid.New().String(),
-        Username: r.FormValue("username"),
+        Username: username,
         IsAdmin:  true,
+        Role:     models.RoleAdmin,
     }
 
     if err := h.store.CreateUser(adminUser, r.FormValue("password")); err != nil {
@@ -141,14 +208,19 @@ func (h *Handler) Setup(w http.ResponseWriter, r *http.Request) {
     }
 
     // Create session and redirect to device setup
-    session := h.sessionManager.CreateSession(adminUser.ID)
-    h.sessionManager.SetSessionCookie(w, session)
+    if err := h.sessionManager.StartSession(w, r, adminUser.ID); err != nil {
+        http.Error(w, "Failed to create session", http.StatusInternalServerError)
+        return
+    }
     http.Redirect(w, r, "/onboarding", http.StatusSeeOther)
 }
 
 func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
     if r.Method == "GET" {
-        h.templates.ExecuteTemplate(w, "login.html", nil)
+        h.templates.ExecuteTemplate(w, "login.html", map[string]interface{}{
+            "OIDC":      h.sso != nil,
+            "CSRFToken": csrfToken(r),
+        })
         return
     }
 
@@ -157,16 +229,61 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    user, err := h.store.ValidateUser(r.FormValue("username"), r.FormValue("password"))
+    username := r.FormValue("username")
+    keys := throttleKeys(r, username)
+    if wait := h.throttle.wait(keys...); wait > 0 {
+        retryAfter(w, wait)
+        w.WriteHeader(http.StatusTooManyRequests)
+        h.templates.ExecuteTemplate(w, "login.html", map[string]interface{}{
+            "Error":     "Too many failed attempts, please wait before trying again",
+            "OIDC":      h.sso != nil,
+            "CSRFToken": csrfToken(r),
+        })
+        return
+    }
+
+    user, err := h.store.ValidateUser(username, r.FormValue("password"))
     if err != nil {
-        h.templates.ExecuteTemplate(w, "login.html", map[string]string{
-            "Error": "Invalid username or password",
+        message := "Invalid username or password"
+        switch err {
+        case store.ErrLocked:
+            message = "This account is temporarily locked after too many failed logins"
+        case store.ErrInvalidPassword:
+            h.throttle.fail(keys...)
+            if user := h.loginUser(username); user != nil {
+                h.loginFailed(r, user, models.AuditLoginFailed)
+            }
+        case store.ErrNotFound:
+            h.throttle.fail(keys...)
+            loginFailures.Inc("unknown_user")
+            h.audit(r, models.AuditLoginFailed, username, "unknown user")
+        }
+
+        w.WriteHeader(http.StatusUnauthorized)
+        h.templates.ExecuteTemplate(w, "login.html", map[string]interface{}{
+            "Error":     message,
+            "OIDC":      h.sso != nil,
+            "CSRFToken": csrfToken(r),
         })
         return
     }
 
-    session := h.sessionManager.CreateSession(user.ID)
-    h.sessionManager.SetSessionCookie(w, session)
+    h.throttle.reset(keys[1])
+    if user.FailedLogins > 0 {
+        if err := h.store.ResetLoginFailures(user.ID); err != nil {
+            log.Printf("Failed to reset login failures for %s: %v", user.Username, err)
+        }
+    }
+
+    if user.TOTPEnabled || user.TOTPRequired {
+        h.startSecondFactor(w, r, user)
+        return
+    }
+
+    if err := h.sessionManager.StartSession(w, r, user.ID); err != nil {
+        http.Error(w, "Failed to create session", http.StatusInternalServerError)
+        return
+    }
     http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
@@ -186,8 +303,17 @@ func (h *Handler) Onboarding(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // Adding devices and controller credentials is for admins only
+    user, err := h.store.GetUserByID(session.UserID)
+    if err != nil || user.Role != models.RoleAdmin || user.Disabled {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+
     if r.Method == "GET" {
-        h.templates.ExecuteTemplate(w, "onboarding.html", nil)
+        h.templates.ExecuteTemplate(w, "onboarding.html", map[string]interface{}{
+            "CSRFToken": csrfToken(r),
+        })
         return
     }
 
@@ -196,6 +322,14 @@ func (h *Handler) Onboarding(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // How to check the controller's certificate; pinned on first use
+    // unless the form asks otherwise
+    tlsSettings := &models.UnifiDevice{TLSVerify: r.FormValue("tls_verify"), TLSCA: r.FormValue("tls_ca")}
+    if err := validateDeviceTLS(tlsSettings); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
     useGlobalCreds := r.FormValue("use_global") == "true"
     
     // Create credentials
@@ -235,6 +369,8 @@ func (h *Handler) Onboarding(w http.ResponseWriter, r *http.Request) {
         UseGlobal:   useGlobalCreds,
         CreatedBy:   session.UserID,
         Credentials: creds,
+        TLSVerify:   tlsSettings.TLSVerify,
+        TLSCA:       tlsSettings.TLSCA,
     }
 
     if err := h.store.CreateDevice(device); err != nil {
@@ -253,16 +389,13 @@ func (h *Handler) GetDevices(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    if devices == nil {
+        devices = []*models.UnifiDevice{}
+    }
     json.NewEncoder(w).Encode(devices)
 }
 
 func (h *Handler) AddDevice(w http.ResponseWriter, r *http.Request) {
-    session := h.sessionManager.GetSessionFromRequest(r)
-    if session == nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
-
     var device models.UnifiDevice
     if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
         http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -270,7 +403,12 @@ func (h *Handler) AddDevice(w http.ResponseWriter, r *http.Request) {
     }
 
     device.ID = uuid.New().String()
-    device.CreatedBy = session.UserID
+    device.CreatedBy = accessFrom(r).User.ID
+    device.TLSFingerprint = ""
+    if err := validateDeviceTLS(&device); err != nil {
+        badRequest(w, err)
+        return
+    }
 
     if err := h.store.CreateDevice(&device); err != nil {
         http.Error(w, "Failed to save device", http.StatusInternalServerError)
@@ -1,10 +1,24 @@
 package handlers
 
 import (
-    "log"
+    "context"
+    "log/slog"
     "net/http"
+    "regexp"
     "runtime/debug"
+    "strconv"
+    "strings"
     "time"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/logging"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/metrics"
+)
+
+var (
+    httpRequests = metrics.NewCounter("unifi_dns_http_requests_total",
+        "HTTP requests by method, path and status.", "method", "path", "status")
+    httpDuration = metrics.NewHistogram("unifi_dns_http_request_duration_seconds",
+        "HTTP request latency in seconds.", metrics.DefaultBuckets, "method", "path")
 )
 
 type statusWriter struct {
@@ -18,6 +32,10 @@ func (w *statusWriter) WriteHeader(status int) {
     w.ResponseWriter.WriteHeader(status)
 }
 
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
 func (w *statusWriter) Write(b []byte) (int, error) {
     if w.status == 0 {
         w.status = 200
@@ -34,14 +52,29 @@ func LoggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
         next.ServeHTTP(sw, r)
 
-        log.Printf(
-            "%s %s %d %s %d bytes %v",
-            r.RemoteAddr,
-            r.Method,
-            sw.status,
-            r.URL.Path,
-            sw.length,
-            time.Since(start),
+        status := sw.status
+        if status == 0 {
+            status = http.StatusOK
+        }
+        // Label unknown paths alike so scanners cannot create new series
+        path := r.URL.Path
+        if status == http.StatusNotFound {
+            path = "unmatched"
+        }
+        httpRequests.Inc(r.Method, path, strconv.Itoa(status))
+        httpDuration.Observe(time.Since(start).Seconds(), r.Method, path)
+
+        level := slog.LevelInfo
+        if status >= 500 {
+            level = slog.LevelError
+        }
+        logging.FromContext(r.Context()).Log(r.Context(), level, "HTTP request",
+            "method", r.Method,
+            "path", r.URL.Path,
+            "status", status,
+            "bytes", sw.length,
+            "duration", time.Since(start),
+            "remote_addr", r.RemoteAddr,
         )
     }
 }
@@ -50,7 +83,7 @@ func RecoveryMiddleware(next http.HandlerFunc) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         defer func() {
             if err := recover(); err != nil {
-                log.Printf("panic: %v\n%s", err, debug.Stack())
+                logging.FromContext(r.Context()).Error("panic", "error", err, "stack", string(debug.Stack()))
                 http.Error(w, "Internal Server Error", http.StatusInternalServerError)
             }
         }()
@@ -58,6 +91,35 @@ func RecoveryMiddleware(next http.HandlerFunc) http.HandlerFunc {
     }
 }
 
+type requestIDKey struct{}
+
+// validRequestID limits the request IDs accepted from clients, so they are
+// safe to log and echo.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestIDMiddleware gives every request an ID, taken from the
+// X-Request-ID header if the client sent a usable one, and returns it in
+// the same header. The ID is added to the request's log fields.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if !validRequestID.MatchString(id) {
+            id = logging.NewID()
+        }
+        w.Header().Set("X-Request-ID", id)
+
+        ctx := logging.NewContext(r.Context(), "request_id", id)
+        ctx = context.WithValue(ctx, requestIDKey{}, id)
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// requestID returns the ID given to r by RequestIDMiddleware.
+func requestID(r *http.Request) string {
+    id, _ := r.Context().Value(requestIDKey{}).(string)
+    return id
+}
+
 func JSONMiddleware(next http.HandlerFunc) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         if r.URL.Path != "/" && r.URL.Path != "/favicon.ico" {
@@ -67,18 +129,32 @@ func JSONMiddleware(next http.HandlerFunc) http.HandlerFunc {
     }
 }
 
-func CORSMiddleware(next http.HandlerFunc) http.HandlerFunc {
-    return func(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("Access-Control-Allow-Origin", "*")
-        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+// NewCORSMiddleware allows cross-origin API calls from the listed origins,
+// such as "https://dash.example.com". Other origins get no CORS headers, so
+// browsers keep them to same-origin requests. Cross-origin callers must
+// authenticate with an API token; cookies are not allowed.
+func NewCORSMiddleware(origins []string) func(http.HandlerFunc) http.HandlerFunc {
+    allowed := make(map[string]bool, len(origins))
+    for _, origin := range origins {
+        allowed[strings.TrimSuffix(origin, "/")] = true
+    }
 
-        if r.Method == "OPTIONS" {
-            w.WriteHeader(http.StatusOK)
-            return
-        }
+    return func(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            w.Header().Add("Vary", "Origin")
+            if origin := r.Header.Get("Origin"); origin != "" && allowed[origin] {
+                w.Header().Set("Access-Control-Allow-Origin", origin)
+                w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+                w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+            }
 
-        next.ServeHTTP(w, r)
+            if r.Method == "OPTIONS" {
+                w.WriteHeader(http.StatusOK)
+                return
+            }
+
+            next.ServeHTTP(w, r)
+        }
     }
 }
 
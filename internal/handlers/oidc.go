@@ -0,0 +1,157 @@
+package handlers
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "log"
+    "net/http"
+
+    "github.com/google/uuid"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+)
+
+const oidcStateCookie = "oidc_state"
+
+// OIDCLogin sends the browser to the identity provider. The state is also
+// kept in a cookie so the callback only completes sign-ins started by the
+// same browser.
+func (h *Handler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+    if h.sso == nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    state, url, err := h.sso.AuthCodeURL()
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    http.SetCookie(w, &http.Cookie{
+        Name:     oidcStateCookie,
+        Value:    state,
+        Path:     "/auth/oidc",
+        MaxAge:   600,
+        HttpOnly: true,
+        Secure:   true,
+        // The callback is a top-level navigation from the provider, which
+        // Strict cookies would not be sent with.
+        SameSite: http.SameSiteLaxMode,
+    })
+    http.Redirect(w, r, url, http.StatusFound)
+}
+
+// OIDCCallback completes a sign-in, provisioning the user on first login and
+// updating their role from their groups when a role map is configured.
+func (h *Handler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+    if h.sso == nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    query := r.URL.Query()
+    http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/oidc", MaxAge: -1})
+
+    if e := query.Get("error"); e != "" {
+        log.Printf("OIDC: provider returned %s: %s", e, query.Get("error_description"))
+        h.loginError(w, r, "Single sign-on failed")
+        return
+    }
+
+    cookie, err := r.Cookie(oidcStateCookie)
+    if err != nil || cookie.Value == "" || cookie.Value != query.Get("state") {
+        h.loginError(w, r, "Single sign-on failed, please try again")
+        return
+    }
+
+    identity, err := h.sso.Exchange(r.Context(), query.Get("state"), query.Get("code"))
+    if err != nil {
+        log.Printf("OIDC: %v", err)
+        h.loginError(w, r, "Single sign-on failed, please try again")
+        return
+    }
+
+    role, allowed := h.sso.Role(identity.Groups)
+    if !allowed {
+        log.Printf("OIDC: %s is not in any group with access", identity.Username)
+        h.loginError(w, r, "Your account has no access to this application")
+        return
+    }
+
+    user, err := h.store.GetUserBySubject(identity.Subject)
+    switch {
+    case err == store.ErrNotFound:
+        user, err = h.provisionUser(identity.Username, identity.Subject, role)
+        if err == store.ErrExists {
+            log.Printf("OIDC: username %s is taken by a local account", identity.Username)
+            h.loginError(w, r, "An account named "+identity.Username+" already exists")
+            return
+        }
+        if err != nil {
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+        log.Printf("OIDC: provisioned %s as %s", user.Username, user.Role)
+
+    case err != nil:
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+
+    case h.sso.MapsRoles() && user.Role != role:
+        previous := user.Role
+        user.Role = role
+        switch err := h.store.UpdateUser(user); err {
+        case nil:
+            log.Printf("OIDC: %s changed from %s to %s by group membership", user.Username, previous, role)
+        case store.ErrLastAdmin:
+            user.Role = previous
+            log.Printf("OIDC: kept %s as %s, the last enabled admin", user.Username, previous)
+        default:
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+    }
+
+    if user.Disabled {
+        h.loginError(w, r, "Your account is disabled")
+        return
+    }
+
+    if err := h.sessionManager.StartSession(w, r, user.ID); err != nil {
+        http.Error(w, "Failed to create session", http.StatusInternalServerError)
+        return
+    }
+    http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// provisionUser creates an account for a first-time single sign-on user. It
+// gets a random password, so it can only sign in through the provider until
+// an admin resets it.
+func (h *Handler) provisionUser(username, subject, role string) (*models.User, error) {
+    secret := make([]byte, 32)
+    if _, err := rand.Read(secret); err != nil {
+        return nil, err
+    }
+
+    user := &models.User{
+        ID:          uuid.New().String(),
+        Username:    username,
+        Role:        role,
+        OIDCSubject: subject,
+    }
+    if err := h.store.CreateUser(user, hex.EncodeToString(secret)); err != nil {
+        return nil, err
+    }
+    return user, nil
+}
+
+func (h *Handler) loginError(w http.ResponseWriter, r *http.Request, message string) {
+    w.WriteHeader(http.StatusUnauthorized)
+    h.templates.ExecuteTemplate(w, "login.html", map[string]interface{}{
+        "Error":     message,
+        "OIDC":      h.sso != nil,
+        "CSRFToken": csrfToken(r),
+    })
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+    "net/http"
+    "reflect"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+    "unicode/utf8"
+)
+
+// openAPIDocument describes the /api/v1 routes as an OpenAPI 3 document.
+// Body schemas are derived from the Go types the handlers encode and
+// decode, so the document follows the code.
+func openAPIDocument(version string, routes []apiRoute) map[string]interface{} {
+    schemas := schemaSet{}
+    errorResponse := map[string]interface{}{
+        "description": "Error",
+        "content":     jsonContent(schemas.of(reflect.TypeOf(APIError{}))),
+    }
+
+    paths := make(map[string]interface{})
+    for _, route := range routes {
+        tag, _, _ := strings.Cut(strings.TrimPrefix(route.path, "/"), "/")
+
+        item := make(map[string]interface{})
+        for _, op := range route.operations {
+            status := op.status
+            if status == 0 {
+                status = http.StatusOK
+            }
+            success := map[string]interface{}{"description": http.StatusText(status)}
+            if op.response != nil {
+                success["content"] = jsonContent(schemas.of(reflect.TypeOf(op.response)))
+            }
+
+            operation := map[string]interface{}{
+                "summary":     op.summary,
+                "description": "Requires the " + route.role + " role.",
+                "tags":        []string{tag},
+                "responses": map[string]interface{}{
+                    strconv.Itoa(status): success,
+                    "default":            errorResponse,
+                },
+            }
+            if len(op.query) > 0 {
+                var params []map[string]interface{}
+                for _, name := range op.query {
+                    params = append(params, map[string]interface{}{
+                        "name":   name,
+                        "in":     "query",
+                        "schema": map[string]interface{}{"type": "string"},
+                    })
+                }
+                operation["parameters"] = params
+            }
+            if op.request != nil {
+                operation["requestBody"] = map[string]interface{}{
+                    "required": true,
+                    "content":  jsonContent(schemas.of(reflect.TypeOf(op.request))),
+                }
+            }
+            item[strings.ToLower(op.method)] = operation
+        }
+        paths[apiV1Prefix+route.path] = item
+    }
+
+    return map[string]interface{}{
+        "openapi": "3.0.3",
+        "info": map[string]interface{}{
+            "title":   "Unifi DNS Manager API",
+            "version": version,
+        },
+        "paths": paths,
+        "components": map[string]interface{}{
+            "schemas": schemas,
+            "securitySchemes": map[string]interface{}{
+                "bearerAuth": map[string]interface{}{
+                    "type":        "http",
+                    "scheme":      "bearer",
+                    "description": "An API token.",
+                },
+                "cookieAuth": map[string]interface{}{
+                    "type":        "apiKey",
+                    "in":          "cookie",
+                    "name":        sessionCookie,
+                    "description": "A browser session. POST, PUT and DELETE requests must also send the " + csrfCookie + " cookie's value in the " + csrfHeader + " header.",
+                },
+            },
+        },
+        "security": []map[string][]string{
+            {"bearerAuth": {}},
+            {"cookieAuth": {}},
+        },
+    }
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+    return map[string]interface{}{
+        "application/json": map[string]interface{}{"schema": schema},
+    }
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaSet holds the component schemas of the named struct types seen so
+// far, by exported type name.
+type schemaSet map[string]interface{}
+
+// of returns the schema of t, adding named structs to the set and
+// referring to them.
+func (s schemaSet) of(t reflect.Type) map[string]interface{} {
+    for t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    if t == timeType {
+        return map[string]interface{}{"type": "string", "format": "date-time"}
+    }
+
+    switch t.Kind() {
+    case reflect.String:
+        return map[string]interface{}{"type": "string"}
+    case reflect.Bool:
+        return map[string]interface{}{"type": "boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return map[string]interface{}{"type": "integer"}
+    case reflect.Float32, reflect.Float64:
+        return map[string]interface{}{"type": "number"}
+    case reflect.Slice, reflect.Array:
+        return map[string]interface{}{"type": "array", "items": s.of(t.Elem())}
+    case reflect.Map:
+        return map[string]interface{}{"type": "object", "additionalProperties": s.of(t.Elem())}
+    case reflect.Struct:
+        if t.Name() == "" {
+            return s.object(t)
+        }
+        r, size := utf8.DecodeRuneInString(t.Name())
+        name := string(unicode.ToUpper(r)) + t.Name()[size:]
+        if _, ok := s[name]; !ok {
+            // Claim the name first so self-referencing types terminate.
+            s[name] = nil
+            s[name] = s.object(t)
+        }
+        return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+    }
+    return map[string]interface{}{}
+}
+
+func (s schemaSet) object(t reflect.Type) map[string]interface{} {
+    properties := make(map[string]interface{})
+    s.addFields(t, properties)
+    return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// addFields adds the JSON fields of struct t, including those of embedded
+// structs, the way encoding/json names them.
+func (s schemaSet) addFields(t reflect.Type, properties map[string]interface{}) {
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        tag := f.Tag.Get("json")
+        if tag == "-" {
+            continue
+        }
+        name, _, _ := strings.Cut(tag, ",")
+
+        if f.Anonymous && name == "" {
+            ft := f.Type
+            if ft.Kind() == reflect.Pointer {
+                ft = ft.Elem()
+            }
+            if ft.Kind() == reflect.Struct {
+                s.addFields(ft, properties)
+                continue
+            }
+        }
+        if !f.IsExported() {
+            continue
+        }
+        if name == "" {
+            name = f.Name
+        }
+        properties[name] = s.of(f.Type)
+    }
+}
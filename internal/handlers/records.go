@@ -0,0 +1,176 @@
+package handlers
+
+import (
+    "encoding/json"
+    "net/http"
+
+    "github.com/google/uuid"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+)
+
+// DNSRecords lists the records of a device (GET) or deletes one (DELETE).
+func (h *Handler) DNSRecords(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case "GET":
+        deviceID := r.URL.Query().Get("device_id")
+        records, err := h.store.ListDNSRecords(deviceID)
+        if err != nil {
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+
+        checks, err := h.store.ListRecordChecks(deviceID)
+        if err != nil {
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+        for _, record := range records {
+            record.Check = checks[record.ID]
+        }
+
+        if records == nil {
+            records = []*models.DNSRecord{}
+        }
+        json.NewEncoder(w).Encode(records)
+
+    case "DELETE":
+        record, ok := h.writableRecord(w, r.URL.Query().Get("record_id"))
+        if !ok {
+            return
+        }
+        if _, ok := h.authorizeDevice(w, r, record.DeviceID, models.RoleOperator); !ok {
+            return
+        }
+
+        if err := h.store.DeleteDNSRecord(record.ID); err != nil {
+            http.Error(w, "Failed to delete record", http.StatusInternalServerError)
+            return
+        }
+        h.syncer.Trigger()
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func (h *Handler) CreateDNSRecord(w http.ResponseWriter, r *http.Request) {
+    var record models.DNSRecord
+    if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    if err := record.Validate(); err != nil {
+        badRequest(w, err)
+        return
+    }
+
+    if _, ok := h.authorizeDevice(w, r, record.DeviceID, models.RoleOperator); !ok {
+        return
+    }
+
+    record.ID = uuid.New().String()
+    record.CreatedBy = accessFrom(r).User.ID
+    record.Source = models.SourceManual
+    record.ReadOnly = false
+
+    if err := h.store.CreateDNSRecord(&record); err != nil {
+        http.Error(w, "Failed to save record", http.StatusInternalServerError)
+        return
+    }
+    h.syncer.Trigger()
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(record)
+}
+
+func (h *Handler) UpdateDNSRecord(w http.ResponseWriter, r *http.Request) {
+    var update models.DNSRecord
+    if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    record, ok := h.writableRecord(w, update.ID)
+    if !ok {
+        return
+    }
+    if _, ok := h.authorizeDevice(w, r, record.DeviceID, models.RoleOperator); !ok {
+        return
+    }
+
+    if err := update.Validate(); err != nil {
+        badRequest(w, err)
+        return
+    }
+
+    record.Name = update.Name
+    record.RRType = update.RRType
+    record.Value = update.Value
+    record.Enabled = update.Enabled
+    record.Description = update.Description
+    record.GeneratePTR = update.GeneratePTR
+
+    if err := h.store.UpdateDNSRecord(record); err != nil {
+        http.Error(w, "Failed to save record", http.StatusInternalServerError)
+        return
+    }
+    h.syncer.Trigger()
+
+    json.NewEncoder(w).Encode(record)
+}
+
+// writableRecord loads a record for modification, replying with an error and
+// returning false if it does not exist or is owned by a sync source.
+func (h *Handler) writableRecord(w http.ResponseWriter, id string) (*models.DNSRecord, bool) {
+    record, err := h.store.GetDNSRecord(id)
+    if err == store.ErrNotFound {
+        http.Error(w, "Record not found", http.StatusNotFound)
+        return nil, false
+    }
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return nil, false
+    }
+
+    if record.ReadOnly {
+        http.Error(w, "Record is managed by "+record.Source+" and is read-only", http.StatusForbidden)
+        return nil, false
+    }
+
+    return record, true
+}
+
+// VerifyDNSRecords queries the device's resolver for each of its enabled
+// records now and returns the results.
+func (h *Handler) VerifyDNSRecords(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    device, ok := h.authorizeDevice(w, r, r.URL.Query().Get("device_id"), models.RoleOperator)
+    if !ok {
+        return
+    }
+
+    checks, err := h.verifier.VerifyDevice(r.Context(), device.ID)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    if checks == nil {
+        checks = []*models.RecordCheck{}
+    }
+    json.NewEncoder(w).Encode(checks)
+}
+
+// PTRConflicts lists addresses claimed by more than one name when PTR records
+// were last derived.
+func (h *Handler) PTRConflicts(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(h.syncer.PTRConflicts())
+}
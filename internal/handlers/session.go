@@ -1,86 +1,168 @@
 package handlers
 
 import (
+    "context"
+    "crypto/rand"
     "encoding/base64"
+    "log"
     "net/http"
-    "sync"
     "time"
 
-    "github.com/google/uuid"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
 )
 
-type Session struct {
-    ID        string
-    UserID    string
-    CreatedAt time.Time
-    ExpiresAt time.Time
-}
+const (
+    sessionCookie = "session_id"
+
+    // sessionTouchInterval limits how often a session's last use is
+    // written back, so reads don't each cost a database write.
+    sessionTouchInterval = time.Minute
+)
 
+// SessionManager keeps browser sessions in the store, so they survive
+// restarts and can be shared by several instances using the same database.
+// Sessions end after maxAge, or earlier when unused for idleTimeout.
 type SessionManager struct {
-    sessions map[string]*Session
-    mu       sync.RWMutex
+    store       *store.Store
+    idleTimeout time.Duration
+    maxAge      time.Duration
 }
 
-func NewSessionManager() *SessionManager {
+// NewSessionManager returns a session manager. An idleTimeout of zero only
+// ends sessions at their absolute expiry.
+func NewSessionManager(store *store.Store, idleTimeout, maxAge time.Duration) *SessionManager {
     return &SessionManager{
-        sessions: make(map[string]*Session),
+        store:       store,
+        idleTimeout: idleTimeout,
+        maxAge:      maxAge,
     }
 }
 
-func (sm *SessionManager) CreateSession(userID string) *Session {
-    sm.mu.Lock()
-    defer sm.mu.Unlock()
+// Run removes expired sessions every interval until ctx is done.
+func (sm *SessionManager) Run(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        sm.Reap()
 
-    session := &Session{
-        ID:        base64.URLEncoding.EncodeToString(uuid.New().NodeID()),
-        UserID:    userID,
-        CreatedAt: time.Now(),
-        ExpiresAt: time.Now().Add(24 * time.Hour),
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
     }
+}
 
-    sm.sessions[session.ID] = session
-    return session
+func (sm *SessionManager) Reap() {
+    now := time.Now().UTC()
+    var idleSince time.Time
+    if sm.idleTimeout > 0 {
+        idleSince = now.Add(-sm.idleTimeout)
+    }
+
+    n, err := sm.store.DeleteExpiredSessions(now, idleSince)
+    if err != nil {
+        log.Printf("Sessions: failed to remove expired sessions: %v", err)
+        return
+    }
+    if n > 0 {
+        log.Printf("Sessions: removed %d expired sessions", n)
+    }
+}
+
+// CreateSession starts a session for userID, returning it with the secret
+// for the session cookie.
+func (sm *SessionManager) CreateSession(r *http.Request, userID string) (*models.Session, string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return nil, "", err
+    }
+    secret := base64.RawURLEncoding.EncodeToString(b)
+
+    now := time.Now().UTC()
+    session := &models.Session{
+        ID:         hashToken(secret),
+        UserID:     userID,
+        UserAgent:  r.UserAgent(),
+        RemoteAddr: r.RemoteAddr,
+        CreatedAt:  now,
+        LastSeenAt: now,
+        ExpiresAt:  now.Add(sm.maxAge),
+    }
+
+    if err := sm.store.CreateSession(session); err != nil {
+        return nil, "", err
+    }
+    return session, secret, nil
 }
 
-func (sm *SessionManager) GetSession(id string) *Session {
-    sm.mu.RLock()
-    defer sm.mu.RUnlock()
+// StartSession creates a session for userID and sets its cookie.
+func (sm *SessionManager) StartSession(w http.ResponseWriter, r *http.Request, userID string) error {
+    session, secret, err := sm.CreateSession(r, userID)
+    if err != nil {
+        return err
+    }
+    sm.SetSessionCookie(w, secret, session.ExpiresAt)
+    return nil
+}
 
-    session, exists := sm.sessions[id]
-    if !exists {
+// GetSession returns the live session for a cookie secret, or nil.
+func (sm *SessionManager) GetSession(secret string) *models.Session {
+    session, err := sm.store.GetSession(hashToken(secret))
+    if err != nil {
+        if err != store.ErrNotFound {
+            log.Printf("Sessions: failed to load session: %v", err)
+        }
         return nil
     }
 
-    if time.Now().After(session.ExpiresAt) {
-        sm.mu.RUnlock()
-        sm.DestroySession(id)
+    now := time.Now().UTC()
+    if session.Expired(now, sm.idleTimeout) {
+        sm.DestroySession(session.ID)
         return nil
     }
 
+    if now.Sub(session.LastSeenAt) > sessionTouchInterval {
+        if err := sm.store.TouchSession(session.ID, now); err != nil {
+            log.Printf("Sessions: failed to record session use: %v", err)
+        }
+        session.LastSeenAt = now
+    }
+
     return session
 }
 
 func (sm *SessionManager) DestroySession(id string) {
-    sm.mu.Lock()
-    defer sm.mu.Unlock()
-    delete(sm.sessions, id)
+    if err := sm.store.DeleteSession(id); err != nil && err != store.ErrNotFound {
+        log.Printf("Sessions: failed to delete session: %v", err)
+    }
 }
 
-func (sm *SessionManager) SetSessionCookie(w http.ResponseWriter, session *Session) {
+// DestroyUserSessions signs a user out everywhere except the session keep,
+// which may be empty.
+func (sm *SessionManager) DestroyUserSessions(userID, keep string) {
+    if err := sm.store.DeleteUserSessions(userID, keep); err != nil {
+        log.Printf("Sessions: failed to delete sessions of %s: %v", userID, err)
+    }
+}
+
+func (sm *SessionManager) SetSessionCookie(w http.ResponseWriter, secret string, expires time.Time) {
     http.SetCookie(w, &http.Cookie{
-        Name:     "session_id",
-        Value:    session.ID,
+        Name:     sessionCookie,
+        Value:    secret,
         Path:     "/",
         HttpOnly: true,
         Secure:   true,
         SameSite: http.SameSiteStrictMode,
-        Expires:  session.ExpiresAt,
+        Expires:  expires,
     })
 }
 
 func (sm *SessionManager) ClearSessionCookie(w http.ResponseWriter) {
     http.SetCookie(w, &http.Cookie{
-        Name:     "session_id",
+        Name:     sessionCookie,
         Value:    "",
         Path:     "/",
         HttpOnly: true,
@@ -90,10 +172,10 @@ func (sm *SessionManager) ClearSessionCookie(w http.ResponseWriter) {
     })
 }
 
-func (sm *SessionManager) GetSessionFromRequest(r *http.Request) *Session {
-    cookie, err := r.Cookie("session_id")
+func (sm *SessionManager) GetSessionFromRequest(r *http.Request) *models.Session {
+    cookie, err := r.Cookie(sessionCookie)
     if err != nil {
         return nil
     }
     return sm.GetSession(cookie.Value)
-}
\ No newline at end of file
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+)
+
+// sessionInfo is a session, marked if it is the one making the request.
+type sessionInfo struct {
+    *models.Session
+    Current bool `json:"current"`
+}
+
+// Sessions lists the signed in user's sessions (GET), every active session
+// for admins with ?all=true, or signs one out (DELETE ?id=). Users may end
+// their own sessions and admins any session.
+func (h *Handler) Sessions(w http.ResponseWriter, r *http.Request) {
+    access := accessFrom(r)
+    admin := models.RoleIncludes(access.limit(access.User.Role), models.RoleAdmin)
+
+    switch r.Method {
+    case "GET":
+        userID := access.User.ID
+        if admin && r.URL.Query().Get("all") == "true" {
+            userID = ""
+        }
+
+        sessions, err := h.store.ListSessions(userID)
+        if err != nil {
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+
+        current := h.sessionManager.GetSessionFromRequest(r)
+        now := time.Now().UTC()
+        list := []sessionInfo{}
+        for _, session := range sessions {
+            // Expired sessions stay stored until the next reap.
+            if session.Expired(now, h.sessionManager.idleTimeout) {
+                continue
+            }
+            list = append(list, sessionInfo{
+                Session: session,
+                Current: current != nil && current.ID == session.ID,
+            })
+        }
+        json.NewEncoder(w).Encode(list)
+
+    case "DELETE":
+        session, err := h.store.GetSession(r.URL.Query().Get("id"))
+        if err == store.ErrNotFound || (err == nil && session.UserID != access.User.ID && !admin) {
+            http.Error(w, "Session not found", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+
+        h.sessionManager.DestroySession(session.ID)
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// LogoutAllSessions signs the user out of every session, including the
+// current one.
+func (h *Handler) LogoutAllSessions(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    user, ok := sessionUser(w, r)
+    if !ok {
+        return
+    }
+
+    h.sessionManager.DestroyUserSessions(user.ID, "")
+    h.sessionManager.ClearSessionCookie(w)
+    w.WriteHeader(http.StatusNoContent)
+}
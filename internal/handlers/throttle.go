@@ -0,0 +1,236 @@
+package handlers
+
+import (
+    "encoding/json"
+    "log"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/logging"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/metrics"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+)
+
+const (
+    // Failed logins per client address and per username are free up to
+    // loginFreeAttempts, then each one doubles the wait before the next
+    // attempt, from loginBackoffBase up to loginBackoffMax. Counts are
+    // forgotten after loginThrottleWindow without failures.
+    loginFreeAttempts   = 3
+    loginBackoffBase    = time.Second
+    loginBackoffMax     = 5 * time.Minute
+    loginThrottleWindow = time.Hour
+
+    // lockoutThreshold consecutive failed logins lock an account for
+    // lockoutDuration, until it expires or an admin unlocks it.
+    lockoutThreshold = 10
+    lockoutDuration  = 15 * time.Minute
+
+    maxAuditEntries = 1000
+)
+
+var loginFailures = metrics.NewCounter("unifi_dns_login_failures_total",
+    "Failed sign-in attempts by reason.", "reason")
+
+type throttleEntry struct {
+    failures int
+    until    time.Time
+    last     time.Time
+}
+
+// loginThrottle slows down password guessing with exponential backoff.
+type loginThrottle struct {
+    mu      sync.Mutex
+    entries map[string]*throttleEntry
+}
+
+func newLoginThrottle() *loginThrottle {
+    return &loginThrottle{entries: make(map[string]*throttleEntry)}
+}
+
+// wait returns how long the caller must wait before another attempt for any
+// of keys.
+func (t *loginThrottle) wait(keys ...string) time.Duration {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    now := time.Now()
+    var wait time.Duration
+    for _, key := range keys {
+        if entry, ok := t.entries[key]; ok && entry.until.Sub(now) > wait {
+            wait = entry.until.Sub(now)
+        }
+    }
+    return wait
+}
+
+func (t *loginThrottle) fail(keys ...string) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    now := time.Now()
+    for key, entry := range t.entries {
+        if now.Sub(entry.last) > loginThrottleWindow {
+            delete(t.entries, key)
+        }
+    }
+
+    for _, key := range keys {
+        entry, ok := t.entries[key]
+        if !ok {
+            entry = &throttleEntry{}
+            t.entries[key] = entry
+        }
+        entry.failures++
+        entry.last = now
+
+        if excess := entry.failures - loginFreeAttempts; excess > 0 {
+            delay := loginBackoffMax
+            if excess <= 16 && loginBackoffBase<<(excess-1) < loginBackoffMax {
+                delay = loginBackoffBase << (excess - 1)
+            }
+            entry.until = now.Add(delay)
+        }
+    }
+}
+
+func (t *loginThrottle) reset(keys ...string) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for _, key := range keys {
+        delete(t.entries, key)
+    }
+}
+
+// clientIP returns the address of the client, without its port.
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// throttleKeys are the limiter keys for a login attempt. Usernames are
+// compared case-insensitively so case changes don't reset the count.
+func throttleKeys(r *http.Request, username string) []string {
+    return []string{"ip:" + clientIP(r), "user:" + strings.ToLower(username)}
+}
+
+// loginFailed counts a failed password or second factor for user, locking
+// the account once it reaches lockoutThreshold.
+func (h *Handler) loginFailed(r *http.Request, user *models.User, event string) {
+    loginFailures.Inc(event)
+    h.audit(r, event, user.Username, "")
+
+    until, err := h.store.RecordLoginFailure(user.ID, lockoutThreshold, lockoutDuration)
+    if err != nil {
+        log.Printf("Failed to record login failure for %s: %v", user.Username, err)
+        return
+    }
+    if until != nil {
+        h.audit(r, models.AuditAccountLocked, user.Username, "until "+until.Format(time.RFC3339))
+    }
+}
+
+// audit records a security event in the audit log.
+func (h *Handler) audit(r *http.Request, event, username, detail string) {
+    entry := &models.AuditEntry{
+        Event:      event,
+        Username:   username,
+        RemoteAddr: clientIP(r),
+        Detail:     detail,
+        RequestID:  requestID(r),
+    }
+
+    logger := logging.FromContext(r.Context())
+    logger.Info("Audit: "+event, "username", username, "remote_addr", entry.RemoteAddr, "detail", detail)
+    if err := h.store.AddAuditEntry(entry); err != nil {
+        logger.Error("Failed to save audit entry", "error", err)
+    }
+}
+
+// retryAfter sets the Retry-After header for a throttled request.
+func retryAfter(w http.ResponseWriter, wait time.Duration) {
+    w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+}
+
+// userRequest names the user an admin action applies to.
+type userRequest struct {
+    ID string `json:"id"`
+}
+
+// UnlockUser lifts a lockout from repeated failed logins.
+func (h *Handler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req userRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    user, err := h.store.GetUserByID(req.ID)
+    if !h.userError(w, err, "Server error") {
+        return
+    }
+    if !h.userError(w, h.store.ResetLoginFailures(user.ID), "Failed to unlock user") {
+        return
+    }
+
+    h.throttle.reset("user:" + strings.ToLower(user.Username))
+    h.audit(r, models.AuditAccountUnlocked, user.Username, "by "+accessFrom(r).User.Username)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// AuditLog lists recent audit entries, newest first (GET ?limit=).
+func (h *Handler) AuditLog(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    limit := 100
+    if value := r.URL.Query().Get("limit"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 1 {
+            http.Error(w, "Invalid limit", http.StatusBadRequest)
+            return
+        }
+        limit = n
+    }
+    if limit > maxAuditEntries {
+        limit = maxAuditEntries
+    }
+
+    entries, err := h.store.ListAuditEntries(limit)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    if entries == nil {
+        entries = []*models.AuditEntry{}
+    }
+    json.NewEncoder(w).Encode(entries)
+}
+
+// loginUser finds the user a failed password login was for, if it exists.
+func (h *Handler) loginUser(username string) *models.User {
+    user, err := h.store.GetUser(username)
+    if err != nil {
+        if err != store.ErrNotFound {
+            log.Printf("Failed to load user %s: %v", username, err)
+        }
+        return nil
+    }
+    return user
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+)
+
+// tokenPrefix marks API token secrets so they are easy to recognise in
+// scripts and secret scanners.
+const tokenPrefix = "uds_"
+
+// newTokenSecret returns a random token secret.
+func newTokenSecret() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return tokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Token secrets are random, so a plain SHA-256 is enough to keep them from
+// being usable if the database leaks.
+func hashToken(secret string) string {
+    sum := sha256.Sum256([]byte(secret))
+    return hex.EncodeToString(sum[:])
+}
+
+// APITokens lists the signed in user's tokens (GET), every token for admins
+// with ?all=true, or revokes one (DELETE ?id=). Users may revoke their own
+// tokens and admins any token.
+func (h *Handler) APITokens(w http.ResponseWriter, r *http.Request) {
+    access := accessFrom(r)
+    admin := models.RoleIncludes(access.limit(access.User.Role), models.RoleAdmin)
+
+    switch r.Method {
+    case "GET":
+        userID := access.User.ID
+        if admin && r.URL.Query().Get("all") == "true" {
+            userID = ""
+        }
+
+        tokens, err := h.store.ListAPITokens(userID)
+        if err != nil {
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+
+        if tokens == nil {
+            tokens = []*models.APIToken{}
+        }
+        json.NewEncoder(w).Encode(tokens)
+
+    case "DELETE":
+        token, err := h.store.GetAPIToken(r.URL.Query().Get("id"))
+        if err == store.ErrNotFound || (err == nil && token.UserID != access.User.ID && !admin) {
+            http.Error(w, "Token not found", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+
+        if err := h.store.DeleteAPIToken(token.ID); err != nil {
+            http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// createdToken is a new token with its secret, which is only ever shown
+// once.
+type createdToken struct {
+    *models.APIToken
+    Secret string `json:"secret"`
+}
+
+type createTokenRequest struct {
+    Name      string     `json:"name"`
+    Scopes    []string   `json:"scopes"`
+    ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// CreateAPIToken issues a token for the signed in user. The secret is only
+// returned in this response. Tokens cannot be used to issue more tokens.
+func (h *Handler) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    access := accessFrom(r)
+    if access.Token != nil {
+        http.Error(w, "API tokens cannot issue tokens", http.StatusForbidden)
+        return
+    }
+
+    var req createTokenRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    req.Name = strings.TrimSpace(req.Name)
+    if req.Name == "" {
+        invalidField(w, "name", "Name is required")
+        return
+    }
+    if len(req.Scopes) == 0 {
+        req.Scopes = []string{models.ScopeRead}
+    }
+    for _, scope := range req.Scopes {
+        if !models.ValidScope(scope) {
+            invalidField(w, "scopes", "Unknown scope "+scope)
+            return
+        }
+    }
+    if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+        invalidField(w, "expires_at", "Expiry is in the past")
+        return
+    }
+
+    secret, err := newTokenSecret()
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    token := &models.APIToken{
+        ID:        uuid.New().String(),
+        UserID:    access.User.ID,
+        Name:      req.Name,
+        Prefix:    secret[:len(tokenPrefix)+6],
+        Hash:      hashToken(secret),
+        Scopes:    req.Scopes,
+        ExpiresAt: req.ExpiresAt,
+    }
+
+    if err := h.store.CreateAPIToken(token); err != nil {
+        http.Error(w, "Failed to save token", http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(createdToken{token, secret})
+}
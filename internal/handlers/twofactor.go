@@ -0,0 +1,506 @@
+package handlers
+
+import (
+    "encoding/json"
+    "html/template"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/twofactor"
+)
+
+const (
+    challengeCookie      = "login_challenge"
+    challengeTimeout     = 5 * time.Minute
+    maxChallengeAttempts = 5
+)
+
+// loginChallenge is a password login waiting for its second factor. Users
+// who are required to use two-factor authentication but have not enrolled
+// yet enroll here before they get a session.
+type loginChallenge struct {
+    userID   string
+    enroll   *twofactor.Enrollment
+    attempts int
+    expires  time.Time
+}
+
+type challengeStore struct {
+    mu         sync.Mutex
+    challenges map[string]*loginChallenge
+}
+
+func newChallengeStore() *challengeStore {
+    return &challengeStore{challenges: make(map[string]*loginChallenge)}
+}
+
+func (cs *challengeStore) create(userID string) (string, error) {
+    id, err := newTokenSecret()
+    if err != nil {
+        return "", err
+    }
+
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    now := time.Now()
+    for key, challenge := range cs.challenges {
+        if now.After(challenge.expires) {
+            delete(cs.challenges, key)
+        }
+    }
+    cs.challenges[id] = &loginChallenge{userID: userID, expires: now.Add(challengeTimeout)}
+    return id, nil
+}
+
+func (cs *challengeStore) get(id string) *loginChallenge {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    challenge, ok := cs.challenges[id]
+    if !ok || time.Now().After(challenge.expires) {
+        delete(cs.challenges, id)
+        return nil
+    }
+    return challenge
+}
+
+// attempt counts a code submission, returning false once the challenge has
+// had too many wrong codes.
+func (cs *challengeStore) attempt(id string) bool {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    challenge, ok := cs.challenges[id]
+    if !ok {
+        return false
+    }
+    challenge.attempts++
+    if challenge.attempts > maxChallengeAttempts {
+        delete(cs.challenges, id)
+        return false
+    }
+    return true
+}
+
+// enrollment returns the enrollment shown for challenge, first starting one
+// for username if start is set and there is none yet. Requests for the same
+// challenge can run concurrently, so it is only touched under cs.mu.
+func (cs *challengeStore) enrollment(challenge *loginChallenge, username string, start bool) (*twofactor.Enrollment, error) {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    if challenge.enroll == nil && start {
+        enroll, err := twofactor.Enroll(username)
+        if err != nil {
+            return nil, err
+        }
+        challenge.enroll = enroll
+    }
+    return challenge.enroll, nil
+}
+
+func (cs *challengeStore) delete(id string) {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    delete(cs.challenges, id)
+}
+
+// startSecondFactor defers the session for a user who passed the password
+// check until they enter a code at /login/2fa.
+func (h *Handler) startSecondFactor(w http.ResponseWriter, r *http.Request, user *models.User) {
+    id, err := h.challenges.create(user.ID)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    http.SetCookie(w, &http.Cookie{
+        Name:     challengeCookie,
+        Value:    id,
+        Path:     "/login",
+        MaxAge:   int(challengeTimeout / time.Second),
+        HttpOnly: true,
+        Secure:   true,
+        SameSite: http.SameSiteStrictMode,
+    })
+    http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+}
+
+// LoginSecondFactor asks for a one-time password or recovery code (or, for
+// users who must enroll, a first code from a new secret) and creates the
+// session once it is correct.
+func (h *Handler) LoginSecondFactor(w http.ResponseWriter, r *http.Request) {
+    cookie, err := r.Cookie(challengeCookie)
+    if err != nil {
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
+    challenge := h.challenges.get(cookie.Value)
+    if challenge == nil {
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
+
+    user, err := h.store.GetUserByID(challenge.userID)
+    if err != nil || user.Disabled || user.Locked(time.Now()) {
+        h.challenges.delete(cookie.Value)
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
+
+    enroll, err := h.challenges.enrollment(challenge, user.Username, !user.TOTPEnabled)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    data := map[string]interface{}{
+        "Enroll":    enroll,
+        "CSRFToken": csrfToken(r),
+    }
+    if enroll != nil {
+        // The QR code is a data URL generated here, which html/template
+        // would otherwise replace.
+        data["QRCode"] = template.URL(enroll.QRCode)
+    }
+
+    if r.Method == "GET" {
+        h.templates.ExecuteTemplate(w, "totp.html", data)
+        return
+    }
+
+    if err := r.ParseForm(); err != nil {
+        http.Error(w, "Invalid form data", http.StatusBadRequest)
+        return
+    }
+
+    if !h.challenges.attempt(cookie.Value) {
+        log.Printf("Too many two-factor attempts for %s", user.Username)
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
+
+    code := r.FormValue("code")
+    var ok bool
+    if enroll != nil {
+        var codes []string
+        codes, ok, err = h.completeEnrollment(user.ID, enroll.Secret, code)
+        data["RecoveryCodes"] = codes
+    } else {
+        ok, err = h.checkSecondFactor(user, code)
+    }
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    if !ok {
+        h.loginFailed(r, user, models.AuditSecondFactorFailed)
+        data["Error"] = "Invalid code"
+        w.WriteHeader(http.StatusUnauthorized)
+        h.templates.ExecuteTemplate(w, "totp.html", data)
+        return
+    }
+
+    h.challenges.delete(cookie.Value)
+    http.SetCookie(w, &http.Cookie{Name: challengeCookie, Path: "/login", MaxAge: -1})
+
+    if err := h.sessionManager.StartSession(w, r, user.ID); err != nil {
+        http.Error(w, "Failed to create session", http.StatusInternalServerError)
+        return
+    }
+
+    // Newly enrolled users see their recovery codes once before continuing.
+    if enroll != nil {
+        h.templates.ExecuteTemplate(w, "totp.html", data)
+        return
+    }
+    http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// checkSecondFactor accepts a current one-time password that has not been
+// used before, or an unused recovery code.
+func (h *Handler) checkSecondFactor(user *models.User, code string) (bool, error) {
+    if twofactor.IsRecoveryCode(code) {
+        ok, err := h.store.UseRecoveryCode(user.ID, twofactor.HashRecoveryCode(code))
+        if ok {
+            log.Printf("%s signed in with a recovery code", user.Username)
+        }
+        return ok, err
+    }
+
+    last, err := h.store.LastTOTPStep(user.ID)
+    if err != nil {
+        return false, err
+    }
+    step, ok := twofactor.Validate(user.TOTPSecret, code, time.Now(), last)
+    if !ok {
+        return false, nil
+    }
+    return h.store.UseTOTPStep(user.ID, step)
+}
+
+// completeEnrollment turns on two-factor authentication with secret if code
+// is valid for it, returning new recovery codes.
+func (h *Handler) completeEnrollment(userID, secret, code string) ([]string, bool, error) {
+    step, ok := twofactor.Validate(secret, code, time.Now(), 0)
+    if !ok {
+        return nil, false, nil
+    }
+
+    if err := h.store.SetTOTP(userID, secret, true); err != nil {
+        return nil, false, err
+    }
+    if _, err := h.store.UseTOTPStep(userID, step); err != nil {
+        return nil, false, err
+    }
+
+    codes, err := h.newRecoveryCodes(userID)
+    return codes, err == nil, err
+}
+
+func (h *Handler) newRecoveryCodes(userID string) ([]string, error) {
+    codes, err := twofactor.RecoveryCodes()
+    if err != nil {
+        return nil, err
+    }
+
+    hashes := make([]string, len(codes))
+    for i, code := range codes {
+        hashes[i] = twofactor.HashRecoveryCode(code)
+    }
+    return codes, h.store.ReplaceRecoveryCodes(userID, hashes)
+}
+
+// sessionUser returns the signed in user for account changes that API
+// tokens may not make.
+func sessionUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+    access := accessFrom(r)
+    if access.Token != nil {
+        http.Error(w, "API tokens cannot change account security settings", http.StatusForbidden)
+        return nil, false
+    }
+    return access.User, true
+}
+
+type twoFactorStatus struct {
+    Enabled                bool `json:"enabled"`
+    Required               bool `json:"required"`
+    RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+// recoveryCodes are shown once, when they are generated.
+type recoveryCodes struct {
+    RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// TwoFactorStatus reports the signed in user's two-factor settings.
+func (h *Handler) TwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+    user := accessFrom(r).User
+
+    remaining, err := h.store.CountRecoveryCodes(user.ID)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    json.NewEncoder(w).Encode(twoFactorStatus{
+        Enabled:                user.TOTPEnabled,
+        Required:               user.TOTPRequired,
+        RecoveryCodesRemaining: remaining,
+    })
+}
+
+// TwoFactorSetup starts enrollment with a new secret, which takes effect
+// once confirmed through TwoFactorEnable.
+func (h *Handler) TwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    user, ok := sessionUser(w, r)
+    if !ok {
+        return
+    }
+    if user.TOTPEnabled {
+        http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+        return
+    }
+
+    enrollment, err := twofactor.Enroll(user.Username)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    if err := h.store.SetTOTP(user.ID, enrollment.Secret, false); err != nil {
+        http.Error(w, "Failed to save secret", http.StatusInternalServerError)
+        return
+    }
+
+    json.NewEncoder(w).Encode(enrollment)
+}
+
+// codeRequest confirms an action with a current two-factor code.
+type codeRequest struct {
+    Code string `json:"code"`
+}
+
+// TwoFactorEnable confirms enrollment with a first code and returns the
+// recovery codes.
+func (h *Handler) TwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    user, ok := sessionUser(w, r)
+    if !ok {
+        return
+    }
+
+    var req codeRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    if user.TOTPEnabled || user.TOTPSecret == "" {
+        http.Error(w, "Start two-factor setup first", http.StatusConflict)
+        return
+    }
+
+    codes, ok, err := h.completeEnrollment(user.ID, user.TOTPSecret, req.Code)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    if !ok {
+        http.Error(w, "Invalid code", http.StatusBadRequest)
+        return
+    }
+
+    json.NewEncoder(w).Encode(recoveryCodes{codes})
+}
+
+type passwordRequest struct {
+    Password string `json:"password"`
+}
+
+// TwoFactorDisable turns two-factor authentication off after checking the
+// user's password, unless an admin requires it.
+func (h *Handler) TwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    user, ok := sessionUser(w, r)
+    if !ok {
+        return
+    }
+
+    var req passwordRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    if user.TOTPRequired {
+        http.Error(w, "Two-factor authentication is required for your account", http.StatusForbidden)
+        return
+    }
+
+    valid, err := h.store.CheckPassword(user.ID, req.Password)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    if !valid {
+        http.Error(w, "Password is incorrect", http.StatusForbidden)
+        return
+    }
+
+    if err := h.store.SetTOTP(user.ID, "", false); err != nil {
+        http.Error(w, "Failed to save settings", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// TwoFactorRecoveryCodes replaces the user's recovery codes after checking
+// a current code.
+func (h *Handler) TwoFactorRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    user, ok := sessionUser(w, r)
+    if !ok {
+        return
+    }
+
+    var req codeRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    if !user.TOTPEnabled {
+        http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+        return
+    }
+
+    valid, err := h.checkSecondFactor(user, req.Code)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    if !valid {
+        http.Error(w, "Invalid code", http.StatusBadRequest)
+        return
+    }
+
+    codes, err := h.newRecoveryCodes(user.ID)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    json.NewEncoder(w).Encode(recoveryCodes{codes})
+}
+
+// ResetTwoFactor removes another user's second factor, for users who lost
+// their authenticator. Users who are required to use one enroll again at
+// their next login.
+func (h *Handler) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req userRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    err := h.store.SetTOTP(req.ID, "", false)
+    if err == store.ErrNotFound {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Failed to save settings", http.StatusInternalServerError)
+        return
+    }
+
+    h.sessionManager.DestroyUserSessions(req.ID, "")
+    w.WriteHeader(http.StatusNoContent)
+}
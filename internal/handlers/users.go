@@ -0,0 +1,308 @@
+package handlers
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+)
+
+const minPasswordLength = 8
+
+// UsersPage renders the user management page for admins.
+func (h *Handler) UsersPage(w http.ResponseWriter, r *http.Request) {
+    session := h.sessionManager.GetSessionFromRequest(r)
+    if session == nil {
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
+
+    user, err := h.store.GetUserByID(session.UserID)
+    if err != nil || user.Disabled {
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
+    if user.Role != models.RoleAdmin {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+
+    data := struct {
+        User      *models.User
+        CSRFToken string
+    }{
+        User:      user,
+        CSRFToken: csrfToken(r),
+    }
+
+    h.templates.ExecuteTemplate(w, "users.html", data)
+}
+
+// Users lists users (GET) or deletes one (DELETE ?id=).
+func (h *Handler) Users(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case "GET":
+        users, err := h.store.ListUsers()
+        if err != nil {
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+
+        if users == nil {
+            users = []*models.User{}
+        }
+        json.NewEncoder(w).Encode(users)
+
+    case "DELETE":
+        id := r.URL.Query().Get("id")
+        if id == accessFrom(r).User.ID {
+            http.Error(w, "You cannot delete your own account", http.StatusBadRequest)
+            return
+        }
+
+        if !h.userError(w, h.store.DeleteUser(id), "Failed to delete user") {
+            return
+        }
+        h.sessionManager.DestroyUserSessions(id, "")
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+type createUserRequest struct {
+    Username string `json:"username"`
+    Password string `json:"password"`
+    Role     string `json:"role"`
+}
+
+func (h *Handler) CreateUser(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req createUserRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    req.Username = strings.TrimSpace(req.Username)
+    if req.Username == "" {
+        invalidField(w, "username", "Username is required")
+        return
+    }
+    if !models.ValidRole(req.Role) {
+        invalidField(w, "role", "Unknown role")
+        return
+    }
+    if len(req.Password) < minPasswordLength {
+        invalidField(w, "password", "Password is too short")
+        return
+    }
+
+    user := &models.User{
+        ID:       uuid.New().String(),
+        Username: req.Username,
+        Role:     req.Role,
+    }
+
+    err := h.store.CreateUser(user, req.Password)
+    if err == store.ErrExists {
+        http.Error(w, "Username is taken", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Failed to save user", http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(user)
+}
+
+// updateUserRequest holds the user settings to change; fields left out
+// keep their current values.
+type updateUserRequest struct {
+    ID           string `json:"id"`
+    Role         string `json:"role,omitempty"`
+    Disabled     *bool  `json:"disabled,omitempty"`
+    TOTPRequired *bool  `json:"totp_required,omitempty"`
+}
+
+// UpdateUser changes a user's role, disables them or requires them to use
+// two-factor authentication.
+func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req updateUserRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    if req.Role != "" && !models.ValidRole(req.Role) {
+        invalidField(w, "role", "Unknown role")
+        return
+    }
+
+    user, err := h.store.GetUserByID(req.ID)
+    if !h.userError(w, err, "Server error") {
+        return
+    }
+
+    if req.Role != "" {
+        user.Role = req.Role
+    }
+    if req.Disabled != nil {
+        user.Disabled = *req.Disabled
+    }
+    if req.TOTPRequired != nil {
+        user.TOTPRequired = *req.TOTPRequired
+    }
+
+    if !h.userError(w, h.store.UpdateUser(user), "Failed to save user") {
+        return
+    }
+    if user.Disabled {
+        h.sessionManager.DestroyUserSessions(user.ID, "")
+    }
+
+    json.NewEncoder(w).Encode(user)
+}
+
+type resetPasswordRequest struct {
+    ID       string `json:"id"`
+    Password string `json:"password"`
+}
+
+// ResetPassword sets another user's password and signs them out.
+func (h *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req resetPasswordRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    if len(req.Password) < minPasswordLength {
+        invalidField(w, "password", "Password is too short")
+        return
+    }
+
+    if !h.userError(w, h.store.SetPassword(req.ID, req.Password), "Failed to save password") {
+        return
+    }
+    h.sessionManager.DestroyUserSessions(req.ID, "")
+    w.WriteHeader(http.StatusNoContent)
+}
+
+type changePasswordRequest struct {
+    CurrentPassword string `json:"current_password"`
+    NewPassword     string `json:"new_password"`
+}
+
+// ChangePassword changes the signed in user's own password, signing out
+// their other sessions.
+func (h *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req changePasswordRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    access := accessFrom(r)
+    if access.Token != nil {
+        http.Error(w, "API tokens cannot change passwords", http.StatusForbidden)
+        return
+    }
+    user := access.User
+
+    // The session is kept while every other one is signed out. It can have
+    // expired since the request was authorized.
+    current := h.sessionManager.GetSessionFromRequest(r)
+    if current == nil || current.UserID != user.ID {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    // Checking the current password is throttled and counts towards the
+    // lockout like a login, so a stolen session cannot guess it.
+    keys := throttleKeys(r, user.Username)
+    if wait := h.throttle.wait(keys...); wait > 0 {
+        retryAfter(w, wait)
+        http.Error(w, "Too many failed attempts, please wait before trying again", http.StatusTooManyRequests)
+        return
+    }
+    if user.Locked(time.Now()) {
+        http.Error(w, "This account is temporarily locked after too many failed logins", http.StatusForbidden)
+        return
+    }
+
+    ok, err := h.store.CheckPassword(user.ID, req.CurrentPassword)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    if !ok {
+        h.throttle.fail(keys...)
+        h.loginFailed(r, user, models.AuditLoginFailed)
+        http.Error(w, "Current password is incorrect", http.StatusForbidden)
+        return
+    }
+    h.throttle.reset(keys[1])
+    if user.FailedLogins > 0 {
+        if err := h.store.ResetLoginFailures(user.ID); err != nil {
+            log.Printf("Failed to reset login failures for %s: %v", user.Username, err)
+        }
+    }
+
+    if len(req.NewPassword) < minPasswordLength {
+        invalidField(w, "new_password", "Password is too short")
+        return
+    }
+
+    if err := h.store.SetPassword(user.ID, req.NewPassword); err != nil {
+        http.Error(w, "Failed to save password", http.StatusInternalServerError)
+        return
+    }
+
+    h.sessionManager.DestroyUserSessions(user.ID, current.ID)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// userError replies to store errors from user changes, returning true when
+// err is nil.
+func (h *Handler) userError(w http.ResponseWriter, err error, message string) bool {
+    switch err {
+    case nil:
+        return true
+    case store.ErrNotFound:
+        http.Error(w, "User not found", http.StatusNotFound)
+    case store.ErrLastAdmin:
+        http.Error(w, "At least one enabled admin is required", http.StatusConflict)
+    default:
+        http.Error(w, message, http.StatusInternalServerError)
+    }
+    return false
+}
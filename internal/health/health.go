@@ -0,0 +1,175 @@
+// Package health serves liveness and readiness probes for Docker and
+// Kubernetes.
+//
+// A Checker runs named checks and answers 200 when all of them pass and 503
+// otherwise, with a JSON body listing each result. Controller reachability
+// is only reported on request (?devices=1) and never fails a probe, since a
+// controller being down is not something restarting this service fixes.
+package health
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/api"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/logging"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+)
+
+// Check returns an error if the thing it checks is unhealthy.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+    name  string
+    check Check
+}
+
+// Result is the outcome of one check.
+type Result struct {
+    Status string `json:"status"`
+    Error  string `json:"error,omitempty"`
+}
+
+// Controller is whether a device's controller could be reached.
+type Controller struct {
+    ID        string `json:"id"`
+    Name      string `json:"name"`
+    Reachable bool   `json:"reachable"`
+    LatencyMS int64  `json:"latency_ms,omitempty"`
+    Error     string `json:"error,omitempty"`
+}
+
+type Checker struct {
+    timeout time.Duration
+    checks  []namedCheck
+
+    // Controllers, if set, reports on the controllers for ?devices=1. The
+    // report names every device and its dial errors, so whoever mounts the
+    // handler should restrict such requests.
+    Controllers func(ctx context.Context) []Controller
+}
+
+// New returns a Checker that gives each check timeout to finish.
+func New(timeout time.Duration) *Checker {
+    return &Checker{timeout: timeout}
+}
+
+// Add registers a check. Checks run in the order they were added.
+func (c *Checker) Add(name string, check Check) {
+    c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+func (c *Checker) Handler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "GET" && r.Method != "HEAD" {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+
+        healthy := true
+        results := make(map[string]Result, len(c.checks))
+        for _, nc := range c.checks {
+            ctx, cancel := context.WithTimeout(r.Context(), c.timeout)
+            err := nc.check(ctx)
+            cancel()
+
+            if err != nil {
+                healthy = false
+                results[nc.name] = Result{Status: "fail", Error: err.Error()}
+            } else {
+                results[nc.name] = Result{Status: "ok"}
+            }
+        }
+
+        body := map[string]interface{}{"status": "ok", "checks": results}
+        status := http.StatusOK
+        if !healthy {
+            body["status"] = "fail"
+            status = http.StatusServiceUnavailable
+        }
+        if c.Controllers != nil && r.URL.Query().Get("devices") != "" {
+            ctx, cancel := context.WithTimeout(r.Context(), c.timeout)
+            body["controllers"] = c.Controllers(ctx)
+            cancel()
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", "no-store")
+        w.WriteHeader(status)
+        json.NewEncoder(w).Encode(body)
+    })
+}
+
+// Database checks that the database answers.
+func Database(s *store.Store) Check {
+    return s.Ping
+}
+
+// Schema checks that every migration this build knows has been applied.
+func Schema(s *store.Store) Check {
+    return func(ctx context.Context) error {
+        current, latest, err := s.SchemaVersion(ctx)
+        if err != nil {
+            return err
+        }
+        if current != latest {
+            return fmt.Errorf("schema is at version %d, expected %d", current, latest)
+        }
+        return nil
+    }
+}
+
+// Heartbeat checks that a background loop has run recently: beat returns
+// when it last did, or the zero time if it never has.
+func Heartbeat(beat func() time.Time, maxAge time.Duration) Check {
+    return func(ctx context.Context) error {
+        last := beat()
+        if last.IsZero() {
+            return errors.New("not started")
+        }
+        if age := time.Since(last); age > maxAge {
+            return fmt.Errorf("last ran %s ago", age.Round(time.Second))
+        }
+        return nil
+    }
+}
+
+// Controllers returns a report that connects to every device's controller
+// in parallel.
+func Controllers(s *store.Store) func(ctx context.Context) []Controller {
+    return func(ctx context.Context) []Controller {
+        devices, err := s.ListDevices()
+        if err != nil {
+            logging.FromContext(ctx).Error("Health: failed to list devices", "error", err)
+            return []Controller{}
+        }
+
+        report := make([]Controller, len(devices))
+        var wg sync.WaitGroup
+        for i, device := range devices {
+            wg.Add(1)
+            go func(i int, id, name, address string) {
+                defer wg.Done()
+                start := time.Now()
+                _, err := api.FetchFingerprint(ctx, address)
+
+                report[i] = Controller{ID: id, Name: name, Reachable: err == nil}
+                if err != nil {
+                    report[i].Error = err.Error()
+                } else {
+                    report[i].LatencyMS = time.Since(start).Milliseconds()
+                }
+            }(i, device.ID, device.Name, device.Address)
+        }
+        wg.Wait()
+
+        sort.Slice(report, func(i, j int) bool { return report[i].Name < report[j].Name })
+        return report
+    }
+}
@@ -0,0 +1,87 @@
+// Package logging sets up structured logging with log/slog and carries
+// fields such as the request ID, user and device through a context, so
+// every line about one request or sync pass can be correlated.
+//
+// Lines written with the log package go through the same handler, at info
+// level.
+package logging
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "log/slog"
+    "strings"
+    "sync"
+)
+
+// Setup makes a logger writing to w the default. level is debug, info,
+// warn or error, and format is text or json. source adds the file and line
+// of each call.
+func Setup(w io.Writer, level, format string, source bool) error {
+    var lvl slog.Level
+    if err := lvl.UnmarshalText([]byte(level)); err != nil {
+        return fmt.Errorf("invalid log level %q", level)
+    }
+
+    options := &slog.HandlerOptions{Level: lvl, AddSource: source}
+    var handler slog.Handler
+    switch strings.ToLower(format) {
+    case "text":
+        handler = slog.NewTextHandler(w, options)
+    case "json":
+        handler = slog.NewJSONHandler(w, options)
+    default:
+        return fmt.Errorf("invalid log format %q", format)
+    }
+
+    slog.SetDefault(slog.New(handler))
+    return nil
+}
+
+// NewID returns a random identifier for a request or sync pass.
+func NewID() string {
+    b := make([]byte, 8)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+type fieldsKey struct{}
+
+// fields are the attributes of an operation's log lines. They are shared by
+// everything handling the operation, so fields added deep inside, such as
+// the signed in user, also appear on the lines written by its callers.
+type fields struct {
+    mu    sync.Mutex
+    attrs []any
+}
+
+// NewContext returns ctx with a new set of fields, starting with args as
+// key-value pairs.
+func NewContext(ctx context.Context, args ...any) context.Context {
+    return context.WithValue(ctx, fieldsKey{}, &fields{attrs: args})
+}
+
+// Add adds key-value pairs to the fields of ctx, if it has any.
+func Add(ctx context.Context, args ...any) {
+    if f, ok := ctx.Value(fieldsKey{}).(*fields); ok {
+        f.mu.Lock()
+        f.attrs = append(f.attrs, args...)
+        f.mu.Unlock()
+    }
+}
+
+// FromContext returns the default logger with the fields of ctx.
+func FromContext(ctx context.Context) *slog.Logger {
+    f, ok := ctx.Value(fieldsKey{}).(*fields)
+    if !ok {
+        return slog.Default()
+    }
+
+    f.mu.Lock()
+    attrs := append([]any{}, f.attrs...)
+    f.mu.Unlock()
+    return slog.Default().With(attrs...)
+}
@@ -0,0 +1,286 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format.
+//
+// Packages declare their metrics as package variables with NewCounter,
+// NewGauge and NewHistogram, which register them with Default. Values that
+// are cheaper to compute when scraped, such as counts from the database,
+// use NewGaugeFunc.
+package metrics
+
+import (
+    "bufio"
+    "fmt"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of latency histograms.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default holds the metrics served by Handler.
+var Default = &Registry{}
+
+// collector writes one metric family.
+type collector interface {
+    write(w *bufio.Writer)
+}
+
+type Registry struct {
+    mu         sync.Mutex
+    collectors []collector
+}
+
+func (r *Registry) register(c collector) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.collectors = append(r.collectors, c)
+}
+
+// Handler serves the registered metrics.
+func (r *Registry) Handler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        r.mu.Lock()
+        collectors := append([]collector{}, r.collectors...)
+        r.mu.Unlock()
+
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        out := bufio.NewWriter(w)
+        for _, c := range collectors {
+            c.write(out)
+        }
+        out.Flush()
+    })
+}
+
+// Handler serves the metrics registered with Default.
+func Handler() http.Handler {
+    return Default.Handler()
+}
+
+// family is the name, help and label names shared by a metric's series.
+type family struct {
+    name   string
+    help   string
+    kind   string
+    labels []string
+
+    mu     sync.Mutex
+    series map[string]*series
+}
+
+type series struct {
+    values []string
+    value  float64
+    // Histograms only: cumulative counts per bucket, and the sum.
+    buckets []uint64
+    sum     float64
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+    return &family{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+}
+
+// get returns the series for the label values, creating it with n buckets.
+// The caller holds f.mu.
+func (f *family) get(values []string, buckets int) *series {
+    if len(values) != len(f.labels) {
+        panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+    }
+
+    key := strings.Join(values, "\xff")
+    s, ok := f.series[key]
+    if !ok {
+        s = &series{values: append([]string{}, values...)}
+        if buckets > 0 {
+            s.buckets = make([]uint64, buckets)
+        }
+        f.series[key] = s
+    }
+    return s
+}
+
+func (f *family) writeHeader(w *bufio.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+}
+
+// sorted returns the series ordered by label values. The caller holds f.mu.
+func (f *family) sorted() []*series {
+    list := make([]*series, 0, len(f.series))
+    for _, s := range f.series {
+        list = append(list, s)
+    }
+    sort.Slice(list, func(i, j int) bool {
+        return strings.Join(list[i].values, "\xff") < strings.Join(list[j].values, "\xff")
+    })
+    return list
+}
+
+// Counter is a value that only goes up, per combination of labels.
+type Counter struct {
+    *family
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+    c := &Counter{newFamily(name, help, "counter", labels)}
+    Default.register(c)
+    return c
+}
+
+// Inc adds one to the series for the label values.
+func (c *Counter) Inc(values ...string) {
+    c.Add(1, values...)
+}
+
+func (c *Counter) Add(v float64, values ...string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.get(values, 0).value += v
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.writeHeader(w)
+    for _, s := range c.sorted() {
+        writeSample(w, c.name, c.labels, s.values, "", "", s.value)
+    }
+}
+
+// Gauge is a value that is set, per combination of labels.
+type Gauge struct {
+    *family
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+    g := &Gauge{newFamily(name, help, "gauge", labels)}
+    Default.register(g)
+    return g
+}
+
+func (g *Gauge) Set(v float64, values ...string) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    g.get(values, 0).value = v
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    g.writeHeader(w)
+    for _, s := range g.sorted() {
+        writeSample(w, g.name, g.labels, s.values, "", "", s.value)
+    }
+}
+
+// Histogram counts observations, such as latencies, into buckets.
+type Histogram struct {
+    *family
+    bounds []float64
+}
+
+func NewHistogram(name, help string, bounds []float64, labels ...string) *Histogram {
+    h := &Histogram{family: newFamily(name, help, "histogram", labels), bounds: bounds}
+    Default.register(h)
+    return h
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    s := h.get(values, len(h.bounds))
+    for i, bound := range h.bounds {
+        if v <= bound {
+            s.buckets[i]++
+        }
+    }
+    s.value++
+    s.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.writeHeader(w)
+    for _, s := range h.sorted() {
+        for i, bound := range h.bounds {
+            writeSample(w, h.name+"_bucket", h.labels, s.values, "le", formatFloat(bound), float64(s.buckets[i]))
+        }
+        writeSample(w, h.name+"_bucket", h.labels, s.values, "le", "+Inf", s.value)
+        writeSample(w, h.name+"_sum", h.labels, s.values, "", "", s.sum)
+        writeSample(w, h.name+"_count", h.labels, s.values, "", "", s.value)
+    }
+}
+
+// GaugeFunc computes its series when scraped. collect calls emit once per
+// series.
+type GaugeFunc struct {
+    *family
+    collect func(emit func(v float64, values ...string))
+}
+
+func NewGaugeFunc(name, help string, collect func(emit func(v float64, values ...string)), labels ...string) *GaugeFunc {
+    g := &GaugeFunc{family: newFamily(name, help, "gauge", labels), collect: collect}
+    Default.register(g)
+    return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    g.series = make(map[string]*series)
+    g.collect(func(v float64, values ...string) {
+        g.get(values, 0).value = v
+    })
+
+    g.writeHeader(w)
+    for _, s := range g.sorted() {
+        writeSample(w, g.name, g.labels, s.values, "", "", s.value)
+    }
+}
+
+// writeSample writes one line, with an extra label such as le if extraName
+// is not empty.
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraName, extraValue string, v float64) {
+    w.WriteString(name)
+    if len(labels) > 0 || extraName != "" {
+        w.WriteByte('{')
+        for i, label := range labels {
+            if i > 0 {
+                w.WriteByte(',')
+            }
+            fmt.Fprintf(w, "%s=\"%s\"", label, escape(values[i]))
+        }
+        if extraName != "" {
+            if len(labels) > 0 {
+                w.WriteByte(',')
+            }
+            fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+        }
+        w.WriteByte('}')
+    }
+    w.WriteByte(' ')
+    w.WriteString(formatFloat(v))
+    w.WriteByte('\n')
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(value string) string {
+    return escaper.Replace(value)
+}
+
+func formatFloat(v float64) string {
+    switch {
+    case math.IsInf(v, 1):
+        return "+Inf"
+    case math.IsInf(v, -1):
+        return "-Inf"
+    }
+    return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -1,47 +1,381 @@
 package models
 
 import (
+    "fmt"
+    "net"
+    "strings"
     "time"
 )
 
+// FieldError is a validation error about one field of a request body,
+// named by its JSON key.
+type FieldError struct {
+    Field   string `json:"field"`
+    Message string `json:"message"`
+}
+
+func (e *FieldError) Error() string {
+    return e.Message
+}
+
+func fieldError(field, format string, args ...interface{}) error {
+    return &FieldError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
 type User struct {
-    ID           string    `json:"id"`
-    Username     string    `json:"username"`
-    PasswordHash string    `json:"-"`
-    IsAdmin      bool      `json:"is_admin"`
-    CreatedAt    time.Time `json:"created_at"`
+    ID           string     `json:"id"`
+    Username     string     `json:"username"`
+    PasswordHash string     `json:"-"`
+    IsAdmin      bool       `json:"is_admin"`
+    Role         string     `json:"role"`
+    Disabled     bool       `json:"disabled"`
+    OIDCSubject  string     `json:"oidc_subject,omitempty"`
+    TOTPSecret   string     `json:"-"`
+    TOTPEnabled  bool       `json:"totp_enabled"`
+    TOTPRequired bool       `json:"totp_required"`
+    FailedLogins int        `json:"failed_logins"`
+    LockedUntil  *time.Time `json:"locked_until,omitempty"`
+    CreatedAt    time.Time  `json:"created_at"`
+}
+
+// Locked reports whether the user is locked out after repeated failed
+// logins.
+func (u *User) Locked(now time.Time) bool {
+    return u.LockedUntil != nil && now.Before(*u.LockedUntil)
+}
+
+// Roles, from least to most privileged. Viewers can read everything,
+// operators can also edit records, and admins can also manage devices,
+// users and grants. A user's role applies to every device; grants raise it
+// for particular devices or device groups.
+const (
+    RoleViewer   = "viewer"
+    RoleOperator = "operator"
+    RoleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{
+    RoleViewer:   1,
+    RoleOperator: 2,
+    RoleAdmin:    3,
+}
+
+func ValidRole(role string) bool {
+    return roleRank[role] > 0
+}
+
+// RoleIncludes reports whether role carries the permissions of required.
+func RoleIncludes(role, required string) bool {
+    return ValidRole(required) && roleRank[role] >= roleRank[required]
+}
+
+// Grant gives a user a role on one device, or on every device in a group.
+type Grant struct {
+    ID        string    `json:"id"`
+    UserID    string    `json:"user_id"`
+    DeviceID  string    `json:"device_id,omitempty"`
+    Group     string    `json:"group,omitempty"`
+    Role      string    `json:"role"`
+    CreatedAt time.Time `json:"created_at"`
+    CreatedBy string    `json:"created_by"`
+}
+
+func (g *Grant) Validate() error {
+    if g.UserID == "" {
+        return fieldError("user_id", "user_id is required")
+    }
+    if (g.DeviceID == "") == (g.Group == "") {
+        return fieldError("device_id", "exactly one of device_id and group is required")
+    }
+    if !ValidRole(g.Role) {
+        return fieldError("role", "unknown role %q", g.Role)
+    }
+    return nil
+}
+
+// Applies reports whether the grant covers device.
+func (g *Grant) Applies(device *UnifiDevice) bool {
+    if g.DeviceID != "" {
+        return g.DeviceID == device.ID
+    }
+    return device.Group != "" && strings.EqualFold(g.Group, device.Group)
+}
+
+// Token scopes limit what a request authenticated with an API token may do,
+// on top of the owner's own role and grants.
+const (
+    ScopeRead  = "read"
+    ScopeWrite = "write"
+    ScopeAdmin = "admin"
+)
+
+var scopeRoles = map[string]string{
+    ScopeRead:  RoleViewer,
+    ScopeWrite: RoleOperator,
+    ScopeAdmin: RoleAdmin,
+}
+
+func ValidScope(scope string) bool {
+    _, ok := scopeRoles[scope]
+    return ok
+}
+
+// APIToken is a long-lived credential for scripts, sent as a bearer token.
+// Only a hash of the secret is stored.
+type APIToken struct {
+    ID         string     `json:"id"`
+    UserID     string     `json:"user_id"`
+    Name       string     `json:"name"`
+    Prefix     string     `json:"prefix"`
+    Hash       string     `json:"-"`
+    Scopes     []string   `json:"scopes"`
+    ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+    LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+    CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Role returns the most privileged role the token's scopes allow.
+func (t *APIToken) Role() string {
+    role := ""
+    for _, scope := range t.Scopes {
+        if r := scopeRoles[scope]; ValidRole(r) && !RoleIncludes(role, r) {
+            role = r
+        }
+    }
+    return role
+}
+
+func (t *APIToken) Expired(now time.Time) bool {
+    return t.ExpiresAt != nil && now.After(*t.ExpiresAt)
+}
+
+// Audit events.
+const (
+    AuditLoginFailed        = "login_failed"
+    AuditSecondFactorFailed = "second_factor_failed"
+    AuditAccountLocked      = "account_locked"
+    AuditAccountUnlocked    = "account_unlocked"
+    AuditSetupDenied        = "setup_denied"
+    AuditCertificatePinned  = "certificate_pinned"
+)
+
+// AuditEntry records a security relevant event.
+type AuditEntry struct {
+    ID         int64     `json:"id"`
+    Event      string    `json:"event"`
+    Username   string    `json:"username"`
+    RemoteAddr string    `json:"remote_addr"`
+    Detail     string    `json:"detail,omitempty"`
+    RequestID  string    `json:"request_id,omitempty"`
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+// Session is a signed in browser. ID is a hash of the secret held in the
+// session cookie, so stored sessions cannot be replayed from the database.
+type Session struct {
+    ID         string    `json:"id"`
+    UserID     string    `json:"user_id"`
+    UserAgent  string    `json:"user_agent"`
+    RemoteAddr string    `json:"remote_addr"`
+    CreatedAt  time.Time `json:"created_at"`
+    LastSeenAt time.Time `json:"last_seen_at"`
+    ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the session has passed its absolute expiry or, if
+// idle is not zero, has been unused for longer than idle.
+func (s *Session) Expired(now time.Time, idle time.Duration) bool {
+    return now.After(s.ExpiresAt) || (idle > 0 && now.After(s.LastSeenAt.Add(idle)))
 }
 
 type UnifiDevice struct {
-    ID          string    `json:"id"`
-    Name        string    `json:"name"`
-    Address     string    `json:"address"`
-    CreatedAt   time.Time `json:"created_at"`
-    CreatedBy   string    `json:"created_by"`
-    UseGlobal   bool      `json:"use_global"`
-    Credentials *UnifiCredentials `json:"credentials,omitempty"`
+    ID          string              `json:"id"`
+    Name        string              `json:"name"`
+    Address     string              `json:"address"`
+    CreatedAt   time.Time           `json:"created_at"`
+    CreatedBy   string              `json:"created_by"`
+    UseGlobal   bool                `json:"use_global"`
+    Domains     []string            `json:"domains"`
+    Resolver    string              `json:"resolver,omitempty"`
+    GeneratePTR bool                `json:"generate_ptr"`
+    Group       string              `json:"group,omitempty"`
+    ClientSync  *ClientSyncSettings `json:"client_sync,omitempty"`
+    Credentials *UnifiCredentials   `json:"credentials,omitempty"`
+
+    // TLSVerify is how the controller's certificate is checked, one of the
+    // TLSVerify constants. TLSCA holds the PEM bundle for TLSVerifyCA, and
+    // TLSFingerprint the pinned certificate for TLSVerifyPin.
+    TLSVerify      string `json:"tls_verify"`
+    TLSCA          string `json:"tls_ca,omitempty"`
+    TLSFingerprint string `json:"tls_fingerprint,omitempty"`
+}
+
+// Ways of verifying a controller's certificate.
+const (
+    // TLSVerifySystem checks the certificate against the system roots.
+    TLSVerifySystem = "system"
+    // TLSVerifyCA checks the certificate against the device's CA bundle.
+    TLSVerifyCA = "ca"
+    // TLSVerifyPin trusts the first certificate seen and then only that
+    // one, for controllers with self-signed certificates.
+    TLSVerifyPin = "pin"
+)
+
+// ValidTLSVerify reports whether mode is a TLSVerify constant.
+func ValidTLSVerify(mode string) bool {
+    return mode == TLSVerifySystem || mode == TLSVerifyCA || mode == TLSVerifyPin
+}
+
+// ClientSyncSettings controls publishing the controller's clients as
+// records named <alias>.<Domain>. Include and Exclude hold network names,
+// network IDs or "vlan:<id>"; an empty Include admits every network.
+type ClientSyncSettings struct {
+    Domain  string   `json:"domain"`
+    Include []string `json:"include,omitempty"`
+    Exclude []string `json:"exclude,omitempty"`
+}
+
+// ServesDomain reports whether name falls under one of the device's domains
+// and returns the length of the longest matching domain, so callers can pick
+// the most specific device when several match.
+func (d *UnifiDevice) ServesDomain(name string) (int, bool) {
+    name = strings.ToLower(strings.TrimSuffix(name, "."))
+    best, ok := 0, false
+    for _, domain := range d.Domains {
+        domain = strings.ToLower(strings.Trim(domain, "."))
+        if domain == "" {
+            continue
+        }
+        if (name == domain || strings.HasSuffix(name, "."+domain)) && len(domain) >= best {
+            best, ok = len(domain), true
+        }
+    }
+    return best, ok
+}
+
+// ResolverAddress returns the host:port of the DNS resolver that answers for
+// the device: the configured resolver, or port 53 on the controller's host.
+func (d *UnifiDevice) ResolverAddress() string {
+    addr := d.Resolver
+    if addr == "" {
+        addr = d.Address
+        if host, _, err := net.SplitHostPort(addr); err == nil {
+            addr = host
+        }
+    }
+    if _, _, err := net.SplitHostPort(addr); err != nil {
+        addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+    }
+    return addr
+}
+
+// DeviceForName returns the device with the most specific domain containing
+// name, or nil if no device serves it.
+func DeviceForName(devices []*UnifiDevice, name string) *UnifiDevice {
+    var best *UnifiDevice
+    bestLen := -1
+    for _, device := range devices {
+        if n, ok := device.ServesDomain(name); ok && n > bestLen {
+            best, bestLen = device, n
+        }
+    }
+    return best
 }
 
 type UnifiCredentials struct {
     ID        string    `json:"id"`
     Username  string    `json:"username"`
-    Password  string    `json:"password"`
+    Password  string    `json:"-"` // never sent to API clients
     IsGlobal  bool      `json:"is_global"`
     CreatedAt time.Time `json:"created_at"`
     CreatedBy string    `json:"created_by"`
 }
 
+// RecordCheck is the outcome of resolving a record through its device's
+// resolver.
+type RecordCheck struct {
+    RecordID  string    `json:"record_id"`
+    Status    string    `json:"status"`
+    Detail    string    `json:"detail,omitempty"`
+    CheckedAt time.Time `json:"checked_at"`
+}
+
+// Record check statuses.
+const (
+    CheckOK       = "ok"
+    CheckMismatch = "mismatch"
+    CheckMissing  = "missing"
+    CheckError    = "error"
+    CheckSkipped  = "skipped"
+)
+
 type DNSRecord struct {
-    ID          string    `json:"id"`
-    Name        string    `json:"name"`
-    RRType      string    `json:"rrtype"`
-    Value       string    `json:"value"`
-    DeviceID    string    `json:"device_id"`
-    Enabled     bool      `json:"enabled"`
-    Description string    `json:"description"`
-    CreatedAt   time.Time `json:"created_at"`
-    UpdatedAt   time.Time `json:"updated_at"`
-    CreatedBy   string    `json:"created_by"`
+    ID          string       `json:"id"`
+    Name        string       `json:"name"`
+    RRType      string       `json:"rrtype"`
+    Value       string       `json:"value"`
+    DeviceID    string       `json:"device_id"`
+    Enabled     bool         `json:"enabled"`
+    Description string       `json:"description"`
+    CreatedAt   time.Time    `json:"created_at"`
+    UpdatedAt   time.Time    `json:"updated_at"`
+    CreatedBy   string       `json:"created_by"`
+    Source      string       `json:"source"`
+    ReadOnly    bool         `json:"read_only"`
+    GeneratePTR bool         `json:"generate_ptr"`
+    Check       *RecordCheck `json:"check,omitempty"`
+}
+
+// Record sources identify what owns a DNS record. Records created through
+// the UI or API are "manual"; everything else is maintained by a sync
+// source and is replaced wholesale when that source reconciles.
+const (
+    SourceManual      = "manual"
+    SourceGitOps      = "gitops"
+    SourceExternalDNS = "external-dns"
+    SourceDocker      = "docker"
+    SourceRFC2136     = "rfc2136"
+    SourcePTR         = "ptr"
+    SourceClients     = "unifi-clients"
+)
+
+// Validate checks that the record is well formed for its type. It does not
+// check that DeviceID refers to an existing device.
+func (r *DNSRecord) Validate() error {
+    r.Name = strings.TrimSuffix(strings.TrimSpace(r.Name), ".")
+    r.RRType = strings.ToUpper(strings.TrimSpace(r.RRType))
+    r.Value = strings.TrimSpace(r.Value)
+
+    if r.Name == "" {
+        return fieldError("name", "name is required")
+    }
+    if r.Value == "" {
+        return fieldError("value", "value is required")
+    }
+
+    switch r.RRType {
+    case "A":
+        if ip := net.ParseIP(r.Value); ip == nil || ip.To4() == nil {
+            return fieldError("value", "%q is not an IPv4 address", r.Value)
+        }
+    case "AAAA":
+        if ip := net.ParseIP(r.Value); ip == nil || ip.To4() != nil {
+            return fieldError("value", "%q is not an IPv6 address", r.Value)
+        }
+    case "CNAME", "NS", "PTR":
+        r.Value = strings.TrimSuffix(r.Value, ".")
+    case "TXT", "SRV", "MX":
+    default:
+        return fieldError("rrtype", "unsupported record type %q", r.RRType)
+    }
+
+    return nil
+}
+
+// Key identifies a record by device, name, type and value. Two records with
+// the same key are duplicates.
+func (r *DNSRecord) Key() string {
+    return strings.Join([]string{r.DeviceID, strings.ToLower(r.Name), r.RRType, r.Value}, "|")
 }
 
 type AppConfig struct {
@@ -0,0 +1,140 @@
+// Package ptr derives reverse DNS (PTR) records from A and AAAA records.
+//
+// A forward record gets a PTR when it, or its device, has generate_ptr set.
+// Derived records carry the ptr source and are recomputed from scratch, so
+// they follow the forward records when those change or are deleted. When
+// several names on a device claim the same address, the oldest forward
+// record wins and the others are reported as conflicts; a PTR that already
+// exists from another source always wins over a derived one.
+package ptr
+
+import (
+    "fmt"
+    "net"
+    "sort"
+    "strings"
+
+    "github.com/google/uuid"
+    "github.com/miekg/dns"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+)
+
+// Conflict describes an address claimed by more than one name.
+type Conflict struct {
+    DeviceID string   `json:"device_id"`
+    Address  string   `json:"address"`
+    PTRName  string   `json:"ptr_name"`
+    Winner   string   `json:"winner"`
+    Losers   []string `json:"losers"`
+}
+
+func (c Conflict) String() string {
+    return fmt.Sprintf("%s is claimed by %s and %s; %s wins",
+        c.Address, c.Winner, strings.Join(c.Losers, ", "), c.Winner)
+}
+
+// Derive returns the PTR records implied by records and any conflicts found.
+// records should hold every record, including existing PTRs.
+func Derive(records []*models.DNSRecord, devices []*models.UnifiDevice) ([]*models.DNSRecord, []Conflict) {
+    enabled := make(map[string]bool)
+    for _, device := range devices {
+        enabled[device.ID] = device.GeneratePTR
+    }
+
+    // PTRs that are maintained by hand or by another source.
+    existing := make(map[string]string)
+    var forward []*models.DNSRecord
+    for _, record := range records {
+        switch {
+        case record.RRType == "PTR" && record.Source != models.SourcePTR:
+            existing[record.DeviceID+"|"+strings.ToLower(record.Name)] = record.Value
+        case record.Enabled && (record.RRType == "A" || record.RRType == "AAAA") &&
+            (record.GeneratePTR || enabled[record.DeviceID]):
+            forward = append(forward, record)
+        }
+    }
+
+    sort.SliceStable(forward, func(i, j int) bool {
+        return forward[i].CreatedAt.Before(forward[j].CreatedAt)
+    })
+
+    claims := make(map[string][]*models.DNSRecord)
+    var order []string
+    for _, record := range forward {
+        name, err := dns.ReverseAddr(net.ParseIP(record.Value).String())
+        if err != nil {
+            continue
+        }
+        k := record.DeviceID + "|" + strings.TrimSuffix(name, ".")
+        if _, ok := claims[k]; !ok {
+            order = append(order, k)
+        }
+        claims[k] = append(claims[k], record)
+    }
+
+    var derived []*models.DNSRecord
+    var conflicts []Conflict
+    for _, k := range order {
+        claimants := uniqueNames(claims[k])
+        winner := claimants[0]
+        ptrName := k[strings.IndexByte(k, '|')+1:]
+
+        conflict := Conflict{
+            DeviceID: winner.DeviceID,
+            Address:  winner.Value,
+            PTRName:  ptrName,
+            Winner:   winner.Name,
+        }
+
+        if value, ok := existing[k]; ok {
+            conflict.Winner = value + " (existing PTR)"
+            for _, c := range claimants {
+                if !strings.EqualFold(c.Name, value) {
+                    conflict.Losers = append(conflict.Losers, c.Name)
+                }
+            }
+            if len(conflict.Losers) > 0 {
+                conflicts = append(conflicts, conflict)
+            }
+            continue
+        }
+
+        for _, c := range claimants[1:] {
+            conflict.Losers = append(conflict.Losers, c.Name)
+        }
+        if len(conflict.Losers) > 0 {
+            conflicts = append(conflicts, conflict)
+        }
+
+        derived = append(derived, &models.DNSRecord{
+            ID:          uuid.New().String(),
+            Name:        ptrName,
+            RRType:      "PTR",
+            Value:       winner.Name,
+            DeviceID:    winner.DeviceID,
+            Enabled:     true,
+            Description: "reverse of " + winner.Name,
+            CreatedBy:   models.SourcePTR,
+            Source:      models.SourcePTR,
+            ReadOnly:    true,
+        })
+    }
+
+    return derived, conflicts
+}
+
+// uniqueNames drops records that repeat an earlier name, as happens when the
+// same name is published by two sources.
+func uniqueNames(records []*models.DNSRecord) []*models.DNSRecord {
+    seen := make(map[string]bool)
+    var unique []*models.DNSRecord
+    for _, record := range records {
+        name := strings.ToLower(record.Name)
+        if !seen[name] {
+            seen[name] = true
+            unique = append(unique, record)
+        }
+    }
+    return unique
+}
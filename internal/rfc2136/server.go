@@ -0,0 +1,466 @@
+// Package rfc2136 accepts DNS UPDATE messages (RFC 2136), as sent by
+// certbot, ISC DHCP or Kea, and applies them to dns_records.
+//
+// Every zone is bound to one device. Updates may add records of any type the
+// controllers support and may only delete records that were themselves
+// created through DNS UPDATE; prerequisites are evaluated against all of the
+// device's records. Every update must be signed with one of the configured
+// TSIG keys; without keys, all updates are refused.
+package rfc2136
+
+import (
+    "context"
+    "encoding/base64"
+    "fmt"
+    "log"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/miekg/dns"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/dnsutil"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/syncer"
+)
+
+// Key is a TSIG key.
+type Key struct {
+    Name      string
+    Algorithm string
+    Secret    string
+}
+
+// ParseKeys parses a comma separated list of name:algorithm:secret TSIG
+// keys, where secret is base64 encoded and algorithm is e.g. hmac-sha256.
+func ParseKeys(s string) ([]Key, error) {
+    var keys []Key
+    for _, entry := range strings.Split(s, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+
+        parts := strings.SplitN(entry, ":", 3)
+        if len(parts) != 3 {
+            return nil, fmt.Errorf("invalid TSIG key %q, want name:algorithm:secret", entry)
+        }
+        if _, err := base64.StdEncoding.DecodeString(parts[2]); err != nil {
+            return nil, fmt.Errorf("TSIG key %s: secret is not base64: %w", parts[0], err)
+        }
+
+        keys = append(keys, Key{
+            Name:      dns.Fqdn(strings.ToLower(parts[0])),
+            Algorithm: dns.Fqdn(strings.ToLower(parts[1])),
+            Secret:    parts[2],
+        })
+    }
+    return keys, nil
+}
+
+// ParseZones parses a comma separated list of zone=device bindings, where
+// device is a device ID or name.
+func ParseZones(s string) (map[string]string, error) {
+    zones := make(map[string]string)
+    for _, entry := range strings.Split(s, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+
+        parts := strings.SplitN(entry, "=", 2)
+        if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+            return nil, fmt.Errorf("invalid zone binding %q, want zone=device", entry)
+        }
+        zones[dns.Fqdn(strings.ToLower(parts[0]))] = parts[1]
+    }
+    return zones, nil
+}
+
+type Server struct {
+    store  *store.Store
+    syncer *syncer.Syncer
+    zones  map[string]string
+    keys   map[string]Key
+
+    // mu makes evaluating prerequisites and applying the update atomic.
+    mu sync.Mutex
+
+    listenersMu sync.Mutex
+    listeners   []*dns.Server
+}
+
+func NewServer(store *store.Store, syncer *syncer.Syncer, zones map[string]string, keys []Key) *Server {
+    s := &Server{
+        store:  store,
+        syncer: syncer,
+        zones:  zones,
+        keys:   make(map[string]Key),
+    }
+    for _, key := range keys {
+        s.keys[key.Name] = key
+    }
+    return s
+}
+
+// ListenAndServe serves updates over UDP and TCP on addr until one of the
+// listeners fails or Shutdown is called.
+func (s *Server) ListenAndServe(addr string) error {
+    secrets := make(map[string]string)
+    for name, key := range s.keys {
+        secrets[name] = key.Secret
+    }
+
+    errs := make(chan error, 2)
+    for _, network := range []string{"udp", "tcp"} {
+        server := &dns.Server{
+            Addr:          addr,
+            Net:           network,
+            Handler:       s,
+            TsigSecret:    secrets,
+            MsgAcceptFunc: acceptUpdates,
+        }
+        s.listenersMu.Lock()
+        s.listeners = append(s.listeners, server)
+        s.listenersMu.Unlock()
+        go func() {
+            errs <- server.ListenAndServe()
+        }()
+    }
+    return <-errs
+}
+
+// Shutdown stops the listeners, waiting for requests in progress until ctx
+// is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+    s.listenersMu.Lock()
+    listeners := s.listeners
+    s.listeners = nil
+    s.listenersMu.Unlock()
+
+    var firstErr error
+    for _, server := range listeners {
+        if err := server.ShutdownContext(ctx); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
+
+// acceptUpdates lets UPDATE messages through, which the default accept
+// function rejects because their prerequisite and update sections hold more
+// than one record.
+func acceptUpdates(dh dns.Header) dns.MsgAcceptAction {
+    if int(dh.Bits>>11)&0xF == dns.OpcodeUpdate {
+        return dns.MsgAccept
+    }
+    return dns.DefaultMsgAcceptFunc(dh)
+}
+
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+    m := new(dns.Msg)
+    m.SetReply(r)
+
+    rcode := s.handle(w, r)
+    m.Rcode = rcode
+
+    if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+        m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+    }
+
+    if rcode != dns.RcodeSuccess {
+        log.Printf("RFC2136: update from %s refused: %s", w.RemoteAddr(), dns.RcodeToString[rcode])
+    }
+    w.WriteMsg(m)
+}
+
+func (s *Server) handle(w dns.ResponseWriter, r *dns.Msg) int {
+    if r.Opcode != dns.OpcodeUpdate {
+        return dns.RcodeNotImplemented
+    }
+
+    if rcode := s.authenticate(w, r); rcode != dns.RcodeSuccess {
+        return rcode
+    }
+
+    // Zone section: exactly one SOA question for a bound zone.
+    if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+        return dns.RcodeFormatError
+    }
+    zone := strings.ToLower(dns.Fqdn(r.Question[0].Name))
+    ref, ok := s.zones[zone]
+    if !ok {
+        return dns.RcodeNotAuth
+    }
+
+    return s.update(zone, ref, r)
+}
+
+// update checks the prerequisites of an authenticated update for zone,
+// bound to the device ref, and applies its changes all or nothing.
+func (s *Server) update(zone, ref string, r *dns.Msg) int {
+    device, err := s.device(ref)
+    if err != nil {
+        log.Printf("RFC2136: zone %s: %v", zone, err)
+        return dns.RcodeServerFailure
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    records, err := s.store.ListDNSRecords(device.ID)
+    if err != nil {
+        log.Printf("RFC2136: %v", err)
+        return dns.RcodeServerFailure
+    }
+
+    if rcode := checkPrerequisites(zone, r.Answer, records); rcode != dns.RcodeSuccess {
+        return rcode
+    }
+
+    adds, deletes, rcode := s.plan(zone, device, r.Ns, records)
+    if rcode != dns.RcodeSuccess {
+        return rcode
+    }
+
+    deleteIDs := make([]string, len(deletes))
+    for i, record := range deletes {
+        deleteIDs[i] = record.ID
+    }
+    if err := s.store.ReplaceDNSRecords(deleteIDs, adds); err != nil {
+        log.Printf("RFC2136: %v", err)
+        return dns.RcodeServerFailure
+    }
+
+    if len(adds)+len(deletes) > 0 {
+        log.Printf("RFC2136: zone %s: %d added, %d deleted", zone, len(adds), len(deletes))
+        s.syncer.Trigger()
+    }
+    return dns.RcodeSuccess
+}
+
+// authenticate requires a valid TSIG signature from a known key.
+func (s *Server) authenticate(w dns.ResponseWriter, r *dns.Msg) int {
+    tsig := r.IsTsig()
+    if tsig == nil {
+        return dns.RcodeRefused
+    }
+
+    key, ok := s.keys[strings.ToLower(tsig.Hdr.Name)]
+    if !ok || !strings.EqualFold(tsig.Algorithm, key.Algorithm) || w.TsigStatus() != nil {
+        return dns.RcodeNotAuth
+    }
+    return dns.RcodeSuccess
+}
+
+func (s *Server) device(ref string) (*models.UnifiDevice, error) {
+    devices, err := s.store.ListDevices()
+    if err != nil {
+        return nil, err
+    }
+    for _, device := range devices {
+        if device.ID == ref || device.Name == ref {
+            return device, nil
+        }
+    }
+    return nil, fmt.Errorf("unknown device %q", ref)
+}
+
+// checkPrerequisites evaluates the prerequisite section (RFC 2136 3.2).
+func checkPrerequisites(zone string, prereqs []dns.RR, records []*models.DNSRecord) int {
+    for _, rr := range prereqs {
+        h := rr.Header()
+        if h.Ttl != 0 {
+            return dns.RcodeFormatError
+        }
+        if !dns.IsSubDomain(zone, h.Name) {
+            return dns.RcodeNotZone
+        }
+        name := recordName(h.Name)
+
+        switch h.Class {
+        case dns.ClassANY:
+            if h.Rdlength != 0 {
+                return dns.RcodeFormatError
+            }
+            if h.Rrtype == dns.TypeANY {
+                if !nameInUse(records, name) {
+                    return dns.RcodeNameError
+                }
+            } else if !rrsetExists(records, name, dns.TypeToString[h.Rrtype]) {
+                return dns.RcodeNXRrset
+            }
+
+        case dns.ClassNONE:
+            if h.Rdlength != 0 {
+                return dns.RcodeFormatError
+            }
+            if h.Rrtype == dns.TypeANY {
+                if nameInUse(records, name) {
+                    return dns.RcodeYXDomain
+                }
+            } else if rrsetExists(records, name, dns.TypeToString[h.Rrtype]) {
+                return dns.RcodeYXRrset
+            }
+
+        case dns.ClassINET:
+            value, ok := dnsutil.Value(rr)
+            if !ok {
+                return dns.RcodeFormatError
+            }
+            if !recordExists(records, name, dns.TypeToString[h.Rrtype], value) {
+                return dns.RcodeNXRrset
+            }
+
+        default:
+            return dns.RcodeFormatError
+        }
+    }
+    return dns.RcodeSuccess
+}
+
+// plan prescans the update section (RFC 2136 3.4.1) and returns the records
+// to create and delete. Nothing is applied unless the whole section is valid.
+func (s *Server) plan(zone string, device *models.UnifiDevice, updates []dns.RR, records []*models.DNSRecord) (adds, deletes []*models.DNSRecord, rcode int) {
+    deleted := make(map[string]bool)
+    remove := func(match func(*models.DNSRecord) bool) {
+        for _, record := range records {
+            if record.Source == models.SourceRFC2136 && !deleted[record.ID] && match(record) {
+                deleted[record.ID] = true
+                deletes = append(deletes, record)
+            }
+        }
+    }
+
+    for _, rr := range updates {
+        h := rr.Header()
+        if !dns.IsSubDomain(zone, h.Name) {
+            return nil, nil, dns.RcodeNotZone
+        }
+        name := recordName(h.Name)
+        rrtype := dns.TypeToString[h.Rrtype]
+
+        // The zone apex SOA and NS records are not ours to change.
+        if h.Rrtype == dns.TypeSOA || (h.Rrtype == dns.TypeNS && dns.Fqdn(h.Name) == zone) {
+            continue
+        }
+
+        switch h.Class {
+        case dns.ClassINET:
+            value, ok := dnsutil.Value(rr)
+            if !ok {
+                return nil, nil, dns.RcodeNotImplemented
+            }
+            record := &models.DNSRecord{
+                ID:        uuid.New().String(),
+                Name:      name,
+                RRType:    rrtype,
+                Value:     value,
+                DeviceID:  device.ID,
+                Enabled:   true,
+                CreatedBy: models.SourceRFC2136,
+                Source:    models.SourceRFC2136,
+                ReadOnly:  true,
+            }
+            if err := record.Validate(); err != nil {
+                return nil, nil, dns.RcodeFormatError
+            }
+            // Records deleted earlier in the update are added again, so
+            // deleting an RRset and adding its values back replaces it.
+            live := false
+            for _, r := range records {
+                if !deleted[r.ID] && r.Key() == record.Key() {
+                    live = true
+                    break
+                }
+            }
+            if live || containsKey(adds, record.Key()) {
+                continue
+            }
+            adds = append(adds, record)
+
+        case dns.ClassANY:
+            if h.Ttl != 0 || h.Rdlength != 0 {
+                return nil, nil, dns.RcodeFormatError
+            }
+            match := func(r *models.DNSRecord) bool {
+                return strings.EqualFold(r.Name, name) && (h.Rrtype == dns.TypeANY || r.RRType == rrtype)
+            }
+            remove(match)
+            adds = dropAdds(adds, match)
+
+        case dns.ClassNONE:
+            if h.Ttl != 0 {
+                return nil, nil, dns.RcodeFormatError
+            }
+            value, ok := dnsutil.Value(rr)
+            if !ok {
+                return nil, nil, dns.RcodeFormatError
+            }
+            match := func(r *models.DNSRecord) bool {
+                return strings.EqualFold(r.Name, name) && r.RRType == rrtype && r.Value == value
+            }
+            remove(match)
+            adds = dropAdds(adds, match)
+
+        default:
+            return nil, nil, dns.RcodeFormatError
+        }
+    }
+
+    return adds, deletes, dns.RcodeSuccess
+}
+
+func recordName(name string) string {
+    return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func nameInUse(records []*models.DNSRecord, name string) bool {
+    for _, r := range records {
+        if strings.EqualFold(r.Name, name) {
+            return true
+        }
+    }
+    return false
+}
+
+func rrsetExists(records []*models.DNSRecord, name, rrtype string) bool {
+    for _, r := range records {
+        if strings.EqualFold(r.Name, name) && r.RRType == rrtype {
+            return true
+        }
+    }
+    return false
+}
+
+func recordExists(records []*models.DNSRecord, name, rrtype, value string) bool {
+    for _, r := range records {
+        if strings.EqualFold(r.Name, name) && r.RRType == rrtype && r.Value == value {
+            return true
+        }
+    }
+    return false
+}
+
+func containsKey(records []*models.DNSRecord, key string) bool {
+    for _, r := range records {
+        if r.Key() == key {
+            return true
+        }
+    }
+    return false
+}
+
+// dropAdds removes pending additions that a later delete in the same update
+// cancels out.
+func dropAdds(adds []*models.DNSRecord, match func(*models.DNSRecord) bool) []*models.DNSRecord {
+    kept := adds[:0]
+    for _, r := range adds {
+        if !match(r) {
+            kept = append(kept, r)
+        }
+    }
+    return kept
+}
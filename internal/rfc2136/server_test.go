@@ -0,0 +1,166 @@
+package rfc2136
+
+import (
+    "database/sql"
+    "path/filepath"
+    "testing"
+
+    "github.com/miekg/dns"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/syncer"
+)
+
+const testZone = "example.com."
+
+func mustRR(t *testing.T, s string) dns.RR {
+    t.Helper()
+    rr, err := dns.NewRR(s)
+    if err != nil {
+        t.Fatalf("parse %q: %v", s, err)
+    }
+    return rr
+}
+
+// deleteRR builds a delete of a whole RRset (class ANY) or of one value
+// (class NONE), which dns.NewRR cannot express.
+func deleteRR(t *testing.T, class uint16, s string) dns.RR {
+    t.Helper()
+    rr := mustRR(t, s)
+    rr.Header().Class = class
+    rr.Header().Ttl = 0
+    if class == dns.ClassANY {
+        return &dns.ANY{Hdr: dns.RR_Header{Name: rr.Header().Name, Rrtype: rr.Header().Rrtype, Class: dns.ClassANY}}
+    }
+    return rr
+}
+
+func rfc2136Record(id, name, rrtype, value string) *models.DNSRecord {
+    return &models.DNSRecord{
+        ID: id, Name: name, RRType: rrtype, Value: value, DeviceID: "dev",
+        Enabled: true, Source: models.SourceRFC2136, ReadOnly: true,
+    }
+}
+
+func TestPlanDeleteThenAddReplacesRRset(t *testing.T) {
+    s := &Server{}
+    device := &models.UnifiDevice{ID: "dev"}
+    records := []*models.DNSRecord{
+        rfc2136Record("1", "host.example.com", "A", "10.0.0.1"),
+        rfc2136Record("2", "host.example.com", "A", "10.0.0.2"),
+    }
+    updates := []dns.RR{
+        deleteRR(t, dns.ClassANY, "host.example.com. 0 IN A 10.0.0.1"),
+        mustRR(t, "host.example.com. 300 IN A 10.0.0.1"),
+        mustRR(t, "host.example.com. 300 IN A 10.0.0.3"),
+    }
+
+    adds, deletes, rcode := s.plan(testZone, device, updates, records)
+    if rcode != dns.RcodeSuccess {
+        t.Fatalf("rcode = %s", dns.RcodeToString[rcode])
+    }
+    if len(deletes) != 2 {
+        t.Errorf("deletes = %d, want both existing records", len(deletes))
+    }
+
+    got := map[string]bool{}
+    for _, r := range adds {
+        got[r.Value] = true
+    }
+    if len(adds) != 2 || !got["10.0.0.1"] || !got["10.0.0.3"] {
+        t.Errorf("adds = %v, want 10.0.0.1 and 10.0.0.3", got)
+    }
+}
+
+func TestPlanSkipsExistingRecord(t *testing.T) {
+    s := &Server{}
+    device := &models.UnifiDevice{ID: "dev"}
+    records := []*models.DNSRecord{rfc2136Record("1", "host.example.com", "A", "10.0.0.1")}
+    updates := []dns.RR{mustRR(t, "host.example.com. 300 IN A 10.0.0.1")}
+
+    adds, deletes, rcode := s.plan(testZone, device, updates, records)
+    if rcode != dns.RcodeSuccess || len(adds) != 0 || len(deletes) != 0 {
+        t.Errorf("got %d adds, %d deletes, rcode %s; want nothing to do", len(adds), len(deletes), dns.RcodeToString[rcode])
+    }
+}
+
+func TestPlanDeleteValueCancelsEarlierAdd(t *testing.T) {
+    s := &Server{}
+    device := &models.UnifiDevice{ID: "dev"}
+    updates := []dns.RR{
+        mustRR(t, "host.example.com. 300 IN A 10.0.0.1"),
+        mustRR(t, "host.example.com. 300 IN A 10.0.0.2"),
+        deleteRR(t, dns.ClassNONE, "host.example.com. 0 IN A 10.0.0.1"),
+    }
+
+    adds, _, rcode := s.plan(testZone, device, updates, nil)
+    if rcode != dns.RcodeSuccess {
+        t.Fatalf("rcode = %s", dns.RcodeToString[rcode])
+    }
+    if len(adds) != 1 || adds[0].Value != "10.0.0.2" {
+        t.Errorf("adds = %d records, want only 10.0.0.2", len(adds))
+    }
+}
+
+func TestAuthenticateRefusesWithoutKeys(t *testing.T) {
+    s := NewServer(nil, nil, map[string]string{testZone: "dev"}, nil)
+    m := new(dns.Msg)
+    m.SetUpdate(testZone)
+
+    if rcode := s.authenticate(nil, m); rcode != dns.RcodeRefused {
+        t.Errorf("rcode = %s, want REFUSED", dns.RcodeToString[rcode])
+    }
+}
+
+func TestUpdateIsAllOrNothing(t *testing.T) {
+    dbPath := filepath.Join(t.TempDir(), "test.db")
+    st, err := store.NewStore(dbPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer st.Close()
+
+    creds := &models.UnifiCredentials{ID: "creds", Username: "admin", Password: "secret"}
+    if err := st.CreateCredentials(creds); err != nil {
+        t.Fatal(err)
+    }
+    if err := st.CreateDevice(&models.UnifiDevice{ID: "dev", Name: "udm", Credentials: creds}); err != nil {
+        t.Fatal(err)
+    }
+    if err := st.CreateDNSRecord(rfc2136Record("1", "host.example.com", "A", "10.0.0.1")); err != nil {
+        t.Fatal(err)
+    }
+
+    // Make the second insert of the update fail.
+    db, err := sql.Open("sqlite3", dbPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if _, err := db.Exec(`CREATE TRIGGER fail_insert BEFORE INSERT ON dns_records
+        WHEN NEW.value = '10.0.0.9' BEGIN SELECT RAISE(ABORT, 'insert failed'); END`); err != nil {
+        t.Fatal(err)
+    }
+
+    s := NewServer(st, syncer.New(st), map[string]string{testZone: "dev"}, nil)
+    m := new(dns.Msg)
+    m.SetUpdate(testZone)
+    m.Ns = []dns.RR{
+        deleteRR(t, dns.ClassANY, "host.example.com. 0 IN A 10.0.0.1"),
+        mustRR(t, "host.example.com. 300 IN A 10.0.0.2"),
+        mustRR(t, "host.example.com. 300 IN A 10.0.0.9"),
+    }
+
+    if rcode := s.update(testZone, "dev", m); rcode != dns.RcodeServerFailure {
+        t.Fatalf("rcode = %s, want SERVFAIL", dns.RcodeToString[rcode])
+    }
+
+    records, err := st.ListDNSRecords("dev")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(records) != 1 || records[0].ID != "1" {
+        t.Errorf("records after failed update = %d, want the original record only", len(records))
+    }
+}
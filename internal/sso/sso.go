@@ -0,0 +1,242 @@
+// Package sso signs users in through an OpenID Connect identity provider
+// using the authorization code flow with PKCE.
+//
+// The provider is configured by discovery from its issuer URL. ID tokens are
+// verified against the provider's keys, the client ID and the nonce sent with
+// the authorization request. Group claims are mapped to roles with a
+// group=role list; the most privileged matching role wins.
+package sso
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/coreos/go-oidc/v3/oidc"
+    "golang.org/x/oauth2"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+)
+
+// loginTimeout bounds how long a user may take at the identity provider.
+const loginTimeout = 10 * time.Minute
+
+var ErrUnknownState = errors.New("unknown or expired login state")
+
+type Config struct {
+    Issuer       string
+    ClientID     string
+    ClientSecret string
+    RedirectURL  string
+    // GroupsClaim names the ID token claim holding the user's groups.
+    GroupsClaim string
+    // RoleMap maps group names to roles.
+    RoleMap map[string]string
+    // DefaultRole is given to users in no mapped group. When empty such
+    // users cannot sign in.
+    DefaultRole string
+}
+
+// Identity is the verified result of a sign-in.
+type Identity struct {
+    // Subject identifies the user uniquely across issuers.
+    Subject  string
+    Username string
+    Email    string
+    Groups   []string
+}
+
+type pending struct {
+    nonce    string
+    verifier string
+    expires  time.Time
+}
+
+type Provider struct {
+    config   Config
+    oauth    *oauth2.Config
+    verifier *oidc.IDTokenVerifier
+
+    mu      sync.Mutex
+    pending map[string]*pending
+}
+
+// New discovers the issuer's endpoints and keys.
+func New(ctx context.Context, config Config) (*Provider, error) {
+    provider, err := oidc.NewProvider(ctx, config.Issuer)
+    if err != nil {
+        return nil, fmt.Errorf("discovery: %w", err)
+    }
+
+    if config.GroupsClaim == "" {
+        config.GroupsClaim = "groups"
+    }
+    if config.DefaultRole != "" && !models.ValidRole(config.DefaultRole) {
+        return nil, fmt.Errorf("unknown default role %q", config.DefaultRole)
+    }
+
+    return &Provider{
+        config: config,
+        oauth: &oauth2.Config{
+            ClientID:     config.ClientID,
+            ClientSecret: config.ClientSecret,
+            RedirectURL:  config.RedirectURL,
+            Endpoint:     provider.Endpoint(),
+            Scopes:       []string{oidc.ScopeOpenID, "profile", "email", "groups"},
+        },
+        verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+        pending:  make(map[string]*pending),
+    }, nil
+}
+
+// AuthCodeURL starts a sign-in, returning the state that identifies it and
+// the URL to send the browser to.
+func (p *Provider) AuthCodeURL() (string, string, error) {
+    state, err := randomString()
+    if err != nil {
+        return "", "", err
+    }
+    nonce, err := randomString()
+    if err != nil {
+        return "", "", err
+    }
+    verifier := oauth2.GenerateVerifier()
+
+    p.mu.Lock()
+    now := time.Now()
+    for key, login := range p.pending {
+        if now.After(login.expires) {
+            delete(p.pending, key)
+        }
+    }
+    p.pending[state] = &pending{nonce: nonce, verifier: verifier, expires: now.Add(loginTimeout)}
+    p.mu.Unlock()
+
+    url := p.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+    return state, url, nil
+}
+
+// Exchange completes the sign-in identified by state, redeeming code and
+// verifying the ID token.
+func (p *Provider) Exchange(ctx context.Context, state, code string) (*Identity, error) {
+    p.mu.Lock()
+    login, ok := p.pending[state]
+    delete(p.pending, state)
+    p.mu.Unlock()
+
+    if !ok || time.Now().After(login.expires) {
+        return nil, ErrUnknownState
+    }
+
+    token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(login.verifier))
+    if err != nil {
+        return nil, fmt.Errorf("token exchange: %w", err)
+    }
+
+    raw, ok := token.Extra("id_token").(string)
+    if !ok {
+        return nil, errors.New("token response has no id_token")
+    }
+
+    idToken, err := p.verifier.Verify(ctx, raw)
+    if err != nil {
+        return nil, fmt.Errorf("id token: %w", err)
+    }
+    if idToken.Nonce != login.nonce {
+        return nil, errors.New("id token: nonce mismatch")
+    }
+
+    var claims map[string]interface{}
+    if err := idToken.Claims(&claims); err != nil {
+        return nil, fmt.Errorf("id token claims: %w", err)
+    }
+
+    identity := &Identity{
+        Subject: idToken.Issuer + "|" + idToken.Subject,
+        Groups:  stringList(claims[p.config.GroupsClaim]),
+    }
+    identity.Email, _ = claims["email"].(string)
+    identity.Username, _ = claims["preferred_username"].(string)
+    if identity.Username == "" {
+        identity.Username = identity.Email
+    }
+    if identity.Username == "" {
+        identity.Username = idToken.Subject
+    }
+
+    return identity, nil
+}
+
+// Role returns the role for a user in groups, or false if they may not sign
+// in.
+func (p *Provider) Role(groups []string) (string, bool) {
+    role := ""
+    for _, group := range groups {
+        if mapped, ok := p.config.RoleMap[group]; ok && !models.RoleIncludes(role, mapped) {
+            role = mapped
+        }
+    }
+    if role == "" {
+        role = p.config.DefaultRole
+    }
+    return role, role != ""
+}
+
+// MapsRoles reports whether group membership decides roles, in which case
+// roles are updated on every sign-in.
+func (p *Provider) MapsRoles() bool {
+    return len(p.config.RoleMap) > 0
+}
+
+// ParseRoleMap parses a comma separated list of group=role entries.
+func ParseRoleMap(s string) (map[string]string, error) {
+    roles := make(map[string]string)
+    for _, entry := range strings.Split(s, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+
+        group, role, ok := strings.Cut(entry, "=")
+        group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+        if !ok || group == "" {
+            return nil, fmt.Errorf("invalid entry %q, want group=role", entry)
+        }
+        if !models.ValidRole(role) {
+            return nil, fmt.Errorf("unknown role %q for group %s", role, group)
+        }
+        roles[group] = role
+    }
+    return roles, nil
+}
+
+// stringList accepts a claim holding either a list of strings or a single
+// string.
+func stringList(claim interface{}) []string {
+    switch v := claim.(type) {
+    case string:
+        return []string{v}
+    case []interface{}:
+        var list []string
+        for _, item := range v {
+            if s, ok := item.(string); ok {
+                list = append(list, s)
+            }
+        }
+        return list
+    }
+    return nil
+}
+
+func randomString() (string, error) {
+    b := make([]byte, 24)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
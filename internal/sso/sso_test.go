@@ -0,0 +1,215 @@
+package sso
+
+import (
+    "context"
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+const testClientID = "unifi-dns"
+
+// mockIssuer is an OpenID Connect provider with discovery, JWKS and token
+// endpoints. Its token endpoint answers code "good" with an ID token
+// carrying the nonce of the last authorization request, or wrongNonce when
+// set.
+type mockIssuer struct {
+    *httptest.Server
+    key *rsa.PrivateKey
+
+    mu         sync.Mutex
+    nonce      string
+    wrongNonce bool
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+    t.Helper()
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    m := &mockIssuer{key: key}
+    mux := http.NewServeMux()
+    mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "issuer":                                m.URL,
+            "authorization_endpoint":                m.URL + "/authorize",
+            "token_endpoint":                        m.URL + "/token",
+            "jwks_uri":                              m.URL + "/jwks",
+            "id_token_signing_alg_values_supported": []string{"RS256"},
+        })
+    })
+    mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "keys": []map[string]string{{
+                "kty": "RSA",
+                "alg": "RS256",
+                "use": "sig",
+                "kid": "test",
+                "n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+                "e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+            }},
+        })
+    })
+    mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+        r.ParseForm()
+        if r.FormValue("code") != "good" || r.FormValue("code_verifier") == "" {
+            w.WriteHeader(http.StatusBadRequest)
+            json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+            return
+        }
+
+        m.mu.Lock()
+        nonce := m.nonce
+        if m.wrongNonce {
+            nonce = "other"
+        }
+        m.mu.Unlock()
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "access_token": "access",
+            "token_type":   "Bearer",
+            "expires_in":   3600,
+            "id_token": m.sign(t, map[string]interface{}{
+                "iss":                m.URL,
+                "aud":                testClientID,
+                "sub":                "user-1",
+                "iat":                time.Now().Unix(),
+                "exp":                time.Now().Add(time.Hour).Unix(),
+                "nonce":              nonce,
+                "preferred_username": "alice",
+                "email":              "alice@example.com",
+                "groups":             []string{"dns-operators", "staff"},
+            }),
+        })
+    })
+    m.Server = httptest.NewServer(mux)
+    t.Cleanup(m.Close)
+    return m
+}
+
+func (m *mockIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+    t.Helper()
+    header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+    payload, _ := json.Marshal(claims)
+    signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+    digest := sha256.Sum256([]byte(signed))
+    sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+    if err != nil {
+        t.Fatal(err)
+    }
+    return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize starts a sign-in and records the nonce the issuer will return.
+func (m *mockIssuer) authorize(t *testing.T, p *Provider) string {
+    t.Helper()
+    state, authURL, err := p.AuthCodeURL()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    u, err := url.Parse(authURL)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.HasPrefix(authURL, m.URL+"/authorize") || u.Query().Get("code_challenge_method") != "S256" {
+        t.Fatalf("unexpected authorization URL %s", authURL)
+    }
+
+    m.mu.Lock()
+    m.nonce = u.Query().Get("nonce")
+    m.mu.Unlock()
+    return state
+}
+
+func newTestProvider(t *testing.T, m *mockIssuer) *Provider {
+    t.Helper()
+    p, err := New(context.Background(), Config{
+        Issuer:      m.URL,
+        ClientID:    testClientID,
+        RedirectURL: "https://dns.example.com/auth/oidc/callback",
+        RoleMap:     map[string]string{"dns-operators": "operator", "dns-admins": "admin"},
+    })
+    if err != nil {
+        t.Fatalf("New: %v", err)
+    }
+    return p
+}
+
+func TestExchange(t *testing.T) {
+    m := newMockIssuer(t)
+    p := newTestProvider(t, m)
+
+    identity, err := p.Exchange(context.Background(), m.authorize(t, p), "good")
+    if err != nil {
+        t.Fatalf("Exchange: %v", err)
+    }
+    if identity.Subject != m.URL+"|user-1" || identity.Username != "alice" || identity.Email != "alice@example.com" {
+        t.Errorf("identity = %+v", identity)
+    }
+
+    role, ok := p.Role(identity.Groups)
+    if !ok || role != "operator" {
+        t.Errorf("Role(%v) = %q, %v; want operator", identity.Groups, role, ok)
+    }
+}
+
+func TestExchangeRejectsReusedState(t *testing.T) {
+    m := newMockIssuer(t)
+    p := newTestProvider(t, m)
+
+    state := m.authorize(t, p)
+    if _, err := p.Exchange(context.Background(), state, "good"); err != nil {
+        t.Fatalf("Exchange: %v", err)
+    }
+    if _, err := p.Exchange(context.Background(), state, "good"); !errors.Is(err, ErrUnknownState) {
+        t.Errorf("second Exchange err = %v, want ErrUnknownState", err)
+    }
+}
+
+func TestExchangeRejectsNonceMismatch(t *testing.T) {
+    m := newMockIssuer(t)
+    p := newTestProvider(t, m)
+    m.wrongNonce = true
+
+    if _, err := p.Exchange(context.Background(), m.authorize(t, p), "good"); err == nil || !strings.Contains(err.Error(), "nonce") {
+        t.Errorf("err = %v, want nonce mismatch", err)
+    }
+}
+
+func TestExchangeRejectsBadCode(t *testing.T) {
+    m := newMockIssuer(t)
+    p := newTestProvider(t, m)
+
+    if _, err := p.Exchange(context.Background(), m.authorize(t, p), "bad"); err == nil {
+        t.Error("Exchange with a bad code succeeded")
+    }
+}
+
+func TestRoleWithoutMappedGroup(t *testing.T) {
+    p := &Provider{config: Config{RoleMap: map[string]string{"dns-admins": "admin"}}}
+    if _, ok := p.Role([]string{"staff"}); ok {
+        t.Error("user in no mapped group may sign in without a default role")
+    }
+
+    p.config.DefaultRole = "viewer"
+    if role, ok := p.Role([]string{"staff"}); !ok || role != "viewer" {
+        t.Errorf("Role = %q, %v; want viewer", role, ok)
+    }
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+    "time"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+)
+
+const grantColumns = "id, user_id, device_id, device_group, role, created_at, created_by"
+
+func (s *Store) CreateGrant(grant *models.Grant) error {
+    grant.CreatedAt = time.Now()
+
+    _, err := s.db.Exec(
+        "INSERT INTO grants ("+grantColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+        grant.ID, grant.UserID, grant.DeviceID, grant.Group, grant.Role, grant.CreatedAt, grant.CreatedBy,
+    )
+    return err
+}
+
+// ListGrants returns the grants of a user, or of every user when userID is
+// empty.
+func (s *Store) ListGrants(userID string) ([]*models.Grant, error) {
+    query := "SELECT " + grantColumns + " FROM grants"
+    var args []interface{}
+    if userID != "" {
+        query += " WHERE user_id = ?"
+        args = append(args, userID)
+    }
+
+    rows, err := s.db.Query(query+" ORDER BY created_at", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var grants []*models.Grant
+    for rows.Next() {
+        var grant models.Grant
+        if err := rows.Scan(&grant.ID, &grant.UserID, &grant.DeviceID, &grant.Group, &grant.Role,
+            &grant.CreatedAt, &grant.CreatedBy); err != nil {
+            return nil, err
+        }
+        grants = append(grants, &grant)
+    }
+
+    return grants, rows.Err()
+}
+
+func (s *Store) DeleteGrant(id string) error {
+    result, err := s.db.Exec("DELETE FROM grants WHERE id = ?", id)
+    if err != nil {
+        return err
+    }
+
+    if n, _ := result.RowsAffected(); n == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
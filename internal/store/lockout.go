@@ -0,0 +1,92 @@
+package store
+
+import (
+    "time"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+)
+
+// RecordLoginFailure counts a failed login for a user. Once threshold
+// consecutive failures are reached the user is locked out for lockout and
+// the count starts over; the lockout expiry is returned, or nil.
+func (s *Store) RecordLoginFailure(userID string, threshold int, lockout time.Duration) (*time.Time, error) {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.Exec("UPDATE users SET failed_logins = failed_logins + 1 WHERE id = ?", userID); err != nil {
+        return nil, err
+    }
+
+    var failures int
+    if err := tx.QueryRow("SELECT failed_logins FROM users WHERE id = ?", userID).Scan(&failures); err != nil {
+        return nil, err
+    }
+
+    var until *time.Time
+    if failures >= threshold {
+        t := time.Now().Add(lockout)
+        until = &t
+        if _, err := tx.Exec("UPDATE users SET failed_logins = 0, locked_until = ? WHERE id = ?", t, userID); err != nil {
+            return nil, err
+        }
+    }
+
+    return until, tx.Commit()
+}
+
+// ResetLoginFailures clears a user's failed login count and any lockout,
+// after a successful login or when an admin unlocks them.
+func (s *Store) ResetLoginFailures(userID string) error {
+    result, err := s.db.Exec("UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = ?", userID)
+    if err != nil {
+        return err
+    }
+
+    if n, _ := result.RowsAffected(); n == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+func (s *Store) AddAuditEntry(entry *models.AuditEntry) error {
+    entry.CreatedAt = time.Now()
+
+    result, err := s.db.Exec(
+        "INSERT INTO audit_log (event, username, remote_addr, detail, request_id, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+        entry.Event, entry.Username, entry.RemoteAddr, entry.Detail, entry.RequestID, entry.CreatedAt,
+    )
+    if err != nil {
+        return err
+    }
+
+    entry.ID, err = result.LastInsertId()
+    return err
+}
+
+// ListAuditEntries returns the most recent limit audit entries, newest
+// first.
+func (s *Store) ListAuditEntries(limit int) ([]*models.AuditEntry, error) {
+    rows, err := s.db.Query(
+        "SELECT id, event, username, remote_addr, detail, request_id, created_at FROM audit_log ORDER BY id DESC LIMIT ?",
+        limit,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var entries []*models.AuditEntry
+    for rows.Next() {
+        var entry models.AuditEntry
+        if err := rows.Scan(&entry.ID, &entry.Event, &entry.Username, &entry.RemoteAddr,
+            &entry.Detail, &entry.RequestID, &entry.CreatedAt); err != nil {
+            return nil, err
+        }
+        entries = append(entries, &entry)
+    }
+
+    return entries, rows.Err()
+}
@@ -0,0 +1,311 @@
+package store
+
+import (
+    "database/sql"
+    "time"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+)
+
+const recordColumns = "id, name, rrtype, value, device_id, enabled, description, created_at, updated_at, created_by, source, read_only, generate_ptr"
+
+type scanner interface {
+    Scan(dest ...interface{}) error
+}
+
+// execer and querier are a *sql.DB or a *sql.Tx.
+type execer interface {
+    Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+type querier interface {
+    Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func scanRecord(row scanner) (*models.DNSRecord, error) {
+    var record models.DNSRecord
+    var description sql.NullString
+
+    err := row.Scan(&record.ID, &record.Name, &record.RRType, &record.Value, &record.DeviceID,
+        &record.Enabled, &description, &record.CreatedAt, &record.UpdatedAt, &record.CreatedBy,
+        &record.Source, &record.ReadOnly, &record.GeneratePTR)
+    if err != nil {
+        return nil, err
+    }
+
+    record.Description = description.String
+    return &record, nil
+}
+
+func queryRecords(db querier, query string, args ...interface{}) ([]*models.DNSRecord, error) {
+    rows, err := db.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var records []*models.DNSRecord
+    for rows.Next() {
+        record, err := scanRecord(rows)
+        if err != nil {
+            return nil, err
+        }
+        records = append(records, record)
+    }
+
+    return records, rows.Err()
+}
+
+func (s *Store) CreateDNSRecord(record *models.DNSRecord) error {
+    return insertRecord(s.db, record)
+}
+
+func insertRecord(db execer, record *models.DNSRecord) error {
+    record.CreatedAt = time.Now()
+    record.UpdatedAt = record.CreatedAt
+    if record.Source == "" {
+        record.Source = models.SourceManual
+    }
+
+    _, err := db.Exec(
+        "INSERT INTO dns_records ("+recordColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+        record.ID, record.Name, record.RRType, record.Value, record.DeviceID, record.Enabled,
+        record.Description, record.CreatedAt, record.UpdatedAt, record.CreatedBy,
+        record.Source, record.ReadOnly, record.GeneratePTR,
+    )
+    return err
+}
+
+func (s *Store) GetDNSRecord(id string) (*models.DNSRecord, error) {
+    record, err := scanRecord(s.db.QueryRow(
+        "SELECT "+recordColumns+" FROM dns_records WHERE id = ?",
+        id,
+    ))
+
+    if err == sql.ErrNoRows {
+        return nil, ErrNotFound
+    }
+    return record, err
+}
+
+// ListDNSRecords returns the records for a device, or for all devices when
+// deviceID is empty.
+func (s *Store) ListDNSRecords(deviceID string) ([]*models.DNSRecord, error) {
+    if deviceID == "" {
+        return queryRecords(s.db, "SELECT "+recordColumns+" FROM dns_records ORDER BY name, rrtype")
+    }
+    return queryRecords(s.db,
+        "SELECT "+recordColumns+" FROM dns_records WHERE device_id = ? ORDER BY name, rrtype",
+        deviceID,
+    )
+}
+
+// RecordCount is the number of records of one type on a device.
+type RecordCount struct {
+    Device  string
+    RRType  string
+    Enabled bool
+    Count   int
+}
+
+// CountDNSRecords counts the records by device name, type and whether they
+// are enabled.
+func (s *Store) CountDNSRecords() ([]RecordCount, error) {
+    rows, err := s.db.Query(`SELECT d.name, r.rrtype, r.enabled, COUNT(*)
+        FROM dns_records r JOIN unifi_devices d ON d.id = r.device_id
+        GROUP BY d.name, r.rrtype, r.enabled`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var counts []RecordCount
+    for rows.Next() {
+        var count RecordCount
+        if err := rows.Scan(&count.Device, &count.RRType, &count.Enabled, &count.Count); err != nil {
+            return nil, err
+        }
+        counts = append(counts, count)
+    }
+    return counts, rows.Err()
+}
+
+// ListDNSRecordsBySource returns every record owned by the given source.
+func (s *Store) ListDNSRecordsBySource(source string) ([]*models.DNSRecord, error) {
+    return recordsBySource(s.db, source)
+}
+
+func recordsBySource(db querier, source string) ([]*models.DNSRecord, error) {
+    return queryRecords(db,
+        "SELECT "+recordColumns+" FROM dns_records WHERE source = ? ORDER BY name, rrtype",
+        source,
+    )
+}
+
+func (s *Store) UpdateDNSRecord(record *models.DNSRecord) error {
+    return updateRecord(s.db, record)
+}
+
+func updateRecord(db execer, record *models.DNSRecord) error {
+    record.UpdatedAt = time.Now()
+
+    result, err := db.Exec(
+        "UPDATE dns_records SET name = ?, rrtype = ?, value = ?, device_id = ?, enabled = ?, description = ?, updated_at = ?, source = ?, read_only = ?, generate_ptr = ? WHERE id = ?",
+        record.Name, record.RRType, record.Value, record.DeviceID, record.Enabled,
+        record.Description, record.UpdatedAt, record.Source, record.ReadOnly, record.GeneratePTR, record.ID,
+    )
+    if err != nil {
+        return err
+    }
+
+    if n, _ := result.RowsAffected(); n == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+func (s *Store) DeleteDNSRecord(id string) error {
+    return deleteRecord(s.db, id)
+}
+
+func deleteRecord(db execer, id string) error {
+    if _, err := db.Exec("DELETE FROM record_checks WHERE record_id = ?", id); err != nil {
+        return err
+    }
+
+    result, err := db.Exec("DELETE FROM dns_records WHERE id = ?", id)
+    if err != nil {
+        return err
+    }
+
+    if n, _ := result.RowsAffected(); n == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+// ReplaceDNSRecords deletes the records with the given IDs and creates
+// records in one transaction, so either every change is stored or none is.
+// IDs that no longer exist are skipped.
+func (s *Store) ReplaceDNSRecords(deleteIDs []string, records []*models.DNSRecord) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    for _, id := range deleteIDs {
+        if err := deleteRecord(tx, id); err != nil && err != ErrNotFound {
+            return err
+        }
+    }
+    for _, record := range records {
+        if err := insertRecord(tx, record); err != nil {
+            return err
+        }
+    }
+
+    return tx.Commit()
+}
+
+// ReconcileSource makes the records owned by source match desired, which
+// must all carry that source. When deviceID is set only that device's
+// records are considered. Records are matched by Key; matching records have
+// their enabled flag and description updated, the rest are created or
+// deleted. The changes are made in one transaction, so a failure leaves
+// the source as it was.
+func (s *Store) ReconcileSource(source, deviceID string, desired []*models.DNSRecord) (created, updated, deleted int, err error) {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return 0, 0, 0, err
+    }
+    defer tx.Rollback()
+
+    existing, err := recordsBySource(tx, source)
+    if err != nil {
+        return 0, 0, 0, err
+    }
+    if deviceID != "" {
+        scoped := existing[:0]
+        for _, record := range existing {
+            if record.DeviceID == deviceID {
+                scoped = append(scoped, record)
+            }
+        }
+        existing = scoped
+    }
+
+    current := make(map[string]*models.DNSRecord, len(existing))
+    for _, record := range existing {
+        current[record.Key()] = record
+    }
+
+    for _, record := range desired {
+        key := record.Key()
+        old, ok := current[key]
+        if !ok {
+            if err := insertRecord(tx, record); err != nil {
+                return 0, 0, 0, err
+            }
+            created++
+            continue
+        }
+
+        delete(current, key)
+        if old.Enabled == record.Enabled && old.Description == record.Description {
+            continue
+        }
+
+        old.Enabled = record.Enabled
+        old.Description = record.Description
+        if err := updateRecord(tx, old); err != nil {
+            return 0, 0, 0, err
+        }
+        updated++
+    }
+
+    for _, record := range current {
+        if err := deleteRecord(tx, record.ID); err != nil {
+            return 0, 0, 0, err
+        }
+        deleted++
+    }
+
+    if err := tx.Commit(); err != nil {
+        return 0, 0, 0, err
+    }
+    return created, updated, deleted, nil
+}
+
+func (s *Store) SaveRecordCheck(check *models.RecordCheck) error {
+    _, err := s.db.Exec(
+        "INSERT OR REPLACE INTO record_checks (record_id, status, detail, checked_at) VALUES (?, ?, ?, ?)",
+        check.RecordID, check.Status, check.Detail, check.CheckedAt,
+    )
+    return err
+}
+
+// ListRecordChecks returns the latest check of every record of a device,
+// keyed by record ID.
+func (s *Store) ListRecordChecks(deviceID string) (map[string]*models.RecordCheck, error) {
+    rows, err := s.db.Query(
+        `SELECT c.record_id, c.status, c.detail, c.checked_at FROM record_checks c
+        JOIN dns_records r ON r.id = c.record_id WHERE r.device_id = ? OR ? = ''`,
+        deviceID, deviceID,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    checks := make(map[string]*models.RecordCheck)
+    for rows.Next() {
+        var check models.RecordCheck
+        if err := rows.Scan(&check.RecordID, &check.Status, &check.Detail, &check.CheckedAt); err != nil {
+            return nil, err
+        }
+        checks[check.RecordID] = &check
+    }
+
+    return checks, rows.Err()
+}
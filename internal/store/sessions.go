@@ -0,0 +1,98 @@
+package store
+
+import (
+    "database/sql"
+    "time"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+)
+
+const sessionColumns = "id, user_id, user_agent, remote_addr, created_at, last_seen_at, expires_at"
+
+func (s *Store) CreateSession(session *models.Session) error {
+    _, err := s.db.Exec(
+        "INSERT INTO sessions ("+sessionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+        session.ID, session.UserID, session.UserAgent, session.RemoteAddr,
+        session.CreatedAt, session.LastSeenAt, session.ExpiresAt,
+    )
+    return err
+}
+
+func scanSession(row scanner) (*models.Session, error) {
+    var session models.Session
+    err := row.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.RemoteAddr,
+        &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+    if err == sql.ErrNoRows {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &session, nil
+}
+
+func (s *Store) GetSession(id string) (*models.Session, error) {
+    return scanSession(s.db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id))
+}
+
+// ListSessions returns the sessions of a user, or of every user when userID
+// is empty, most recently used first.
+func (s *Store) ListSessions(userID string) ([]*models.Session, error) {
+    query := "SELECT " + sessionColumns + " FROM sessions"
+    var args []interface{}
+    if userID != "" {
+        query += " WHERE user_id = ?"
+        args = append(args, userID)
+    }
+
+    rows, err := s.db.Query(query+" ORDER BY last_seen_at DESC", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var sessions []*models.Session
+    for rows.Next() {
+        session, err := scanSession(rows)
+        if err != nil {
+            return nil, err
+        }
+        sessions = append(sessions, session)
+    }
+
+    return sessions, rows.Err()
+}
+
+func (s *Store) TouchSession(id string, seenAt time.Time) error {
+    _, err := s.db.Exec("UPDATE sessions SET last_seen_at = ? WHERE id = ?", seenAt, id)
+    return err
+}
+
+func (s *Store) DeleteSession(id string) error {
+    result, err := s.db.Exec("DELETE FROM sessions WHERE id = ?", id)
+    if err != nil {
+        return err
+    }
+
+    if n, _ := result.RowsAffected(); n == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+// DeleteUserSessions removes every session of a user except keep, which may
+// be empty.
+func (s *Store) DeleteUserSessions(userID, keep string) error {
+    _, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ? AND id != ?", userID, keep)
+    return err
+}
+
+// DeleteExpiredSessions removes sessions that expired before now or were
+// last used before idleSince, returning how many were removed.
+func (s *Store) DeleteExpiredSessions(now, idleSince time.Time) (int64, error) {
+    result, err := s.db.Exec("DELETE FROM sessions WHERE expires_at < ? OR last_seen_at < ?", now, idleSince)
+    if err != nil {
+        return 0, err
+    }
+    return result.RowsAffected()
+}
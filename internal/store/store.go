@@ -1,8 +1,12 @@
 package store
 
 import (
+    "context"
     "database/sql"
+    "encoding/json"
     "errors"
+    "fmt"
+    "strings"
     "time"
 
     _ "github.com/mattn/go-sqlite3"
@@ -12,8 +16,13 @@ import (
 )
 
 var (
-    ErrNotFound = errors.New("not found")
-    ErrExists   = errors.New("already exists")
+    ErrNotFound  = errors.New("not found")
+    ErrExists    = errors.New("already exists")
+    ErrLastAdmin = errors.New("at least one enabled admin is required")
+
+    ErrInvalidPassword = errors.New("invalid password")
+    ErrDisabled        = errors.New("user is disabled")
+    ErrLocked          = errors.New("user is locked out")
 )
 
 type Store struct {
@@ -91,72 +100,467 @@ func (s *Store) initSchema() error {
         FOREIGN KEY(global_creds_id) REFERENCES unifi_credentials(id)
     );`
 
-    _, err := s.db.Exec(schema)
-    return err
+    if _, err := s.db.Exec(schema); err != nil {
+        return err
+    }
+
+    return s.migrate()
+}
+
+// migrations are applied in order on top of the base schema. The number of
+// applied migrations is kept in schema_version, so entries must only ever be
+// appended.
+var migrations = []string{
+    `ALTER TABLE dns_records ADD COLUMN source TEXT NOT NULL DEFAULT 'manual';
+    ALTER TABLE dns_records ADD COLUMN read_only BOOLEAN NOT NULL DEFAULT false;`,
+    `ALTER TABLE unifi_devices ADD COLUMN domains TEXT NOT NULL DEFAULT '';
+    CREATE TABLE synced_records (
+        device_id TEXT NOT NULL,
+        remote_id TEXT NOT NULL,
+        name TEXT NOT NULL,
+        rrtype TEXT NOT NULL,
+        value TEXT NOT NULL,
+        synced_at DATETIME NOT NULL,
+        PRIMARY KEY(device_id, remote_id),
+        FOREIGN KEY(device_id) REFERENCES unifi_devices(id)
+    );`,
+    `ALTER TABLE unifi_devices ADD COLUMN resolver TEXT NOT NULL DEFAULT '';
+    CREATE TABLE record_checks (
+        record_id TEXT PRIMARY KEY,
+        status TEXT NOT NULL,
+        detail TEXT NOT NULL,
+        checked_at DATETIME NOT NULL,
+        FOREIGN KEY(record_id) REFERENCES dns_records(id)
+    );`,
+    `ALTER TABLE unifi_devices ADD COLUMN generate_ptr BOOLEAN NOT NULL DEFAULT false;
+    ALTER TABLE dns_records ADD COLUMN generate_ptr BOOLEAN NOT NULL DEFAULT false;`,
+    `ALTER TABLE unifi_devices ADD COLUMN client_sync TEXT NOT NULL DEFAULT '';`,
+    `ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'viewer';
+    UPDATE users SET role = 'admin' WHERE is_admin;
+    ALTER TABLE unifi_devices ADD COLUMN device_group TEXT NOT NULL DEFAULT '';
+    CREATE TABLE grants (
+        id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        device_id TEXT NOT NULL DEFAULT '',
+        device_group TEXT NOT NULL DEFAULT '',
+        role TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        created_by TEXT NOT NULL,
+        FOREIGN KEY(user_id) REFERENCES users(id)
+    );`,
+    `ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT false;`,
+    `CREATE TABLE api_tokens (
+        id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        name TEXT NOT NULL,
+        prefix TEXT NOT NULL,
+        hash TEXT UNIQUE NOT NULL,
+        scopes TEXT NOT NULL,
+        expires_at DATETIME,
+        last_used_at DATETIME,
+        created_at DATETIME NOT NULL,
+        FOREIGN KEY(user_id) REFERENCES users(id)
+    );`,
+    `ALTER TABLE users ADD COLUMN oidc_subject TEXT NOT NULL DEFAULT '';
+    CREATE UNIQUE INDEX users_oidc_subject ON users(oidc_subject) WHERE oidc_subject != '';`,
+    `ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+    ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT false;
+    ALTER TABLE users ADD COLUMN totp_required BOOLEAN NOT NULL DEFAULT false;
+    ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+    CREATE TABLE recovery_codes (
+        user_id TEXT NOT NULL,
+        code_hash TEXT NOT NULL,
+        PRIMARY KEY(user_id, code_hash),
+        FOREIGN KEY(user_id) REFERENCES users(id)
+    );`,
+    `CREATE TABLE sessions (
+        id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        user_agent TEXT NOT NULL,
+        remote_addr TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        last_seen_at DATETIME NOT NULL,
+        expires_at DATETIME NOT NULL,
+        FOREIGN KEY(user_id) REFERENCES users(id)
+    );
+    CREATE INDEX sessions_user_id ON sessions(user_id);`,
+    `ALTER TABLE users ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE users ADD COLUMN locked_until DATETIME;
+    CREATE TABLE audit_log (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        event TEXT NOT NULL,
+        username TEXT NOT NULL,
+        remote_addr TEXT NOT NULL,
+        detail TEXT NOT NULL,
+        created_at DATETIME NOT NULL
+    );`,
+    // app_config used to gain a row on every save while only the first was
+    // read, leaving setup open after it completed. Collapse the rows into
+    // the first, keeping the initialized flag and latest global credentials.
+    `UPDATE app_config SET
+        is_initialized = (SELECT MAX(is_initialized) FROM app_config),
+        global_creds_id = (SELECT global_creds_id FROM app_config WHERE global_creds_id IS NOT NULL ORDER BY rowid DESC LIMIT 1)
+    WHERE rowid = (SELECT MIN(rowid) FROM app_config);
+    DELETE FROM app_config WHERE rowid != (SELECT MIN(rowid) FROM app_config);`,
+    // Controllers used to be contacted without any certificate checks;
+    // pinning on first use keeps them working while catching later changes.
+    `ALTER TABLE unifi_devices ADD COLUMN tls_verify TEXT NOT NULL DEFAULT 'pin';
+    ALTER TABLE unifi_devices ADD COLUMN tls_ca TEXT NOT NULL DEFAULT '';
+    ALTER TABLE unifi_devices ADD COLUMN tls_fingerprint TEXT NOT NULL DEFAULT '';`,
+    `ALTER TABLE audit_log ADD COLUMN request_id TEXT NOT NULL DEFAULT '';`,
+}
+
+func (s *Store) migrate() error {
+    if _, err := s.db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)"); err != nil {
+        return err
+    }
+
+    var version int
+    err := s.db.QueryRow("SELECT version FROM schema_version LIMIT 1").Scan(&version)
+    if err == sql.ErrNoRows {
+        if _, err := s.db.Exec("INSERT INTO schema_version (version) VALUES (0)"); err != nil {
+            return err
+        }
+    } else if err != nil {
+        return err
+    }
+
+    for i := version; i < len(migrations); i++ {
+        tx, err := s.db.Begin()
+        if err != nil {
+            return err
+        }
+        if _, err := tx.Exec(migrations[i]); err != nil {
+            tx.Rollback()
+            return fmt.Errorf("migration %d: %w", i+1, err)
+        }
+        if _, err := tx.Exec("UPDATE schema_version SET version = ?", i+1); err != nil {
+            tx.Rollback()
+            return err
+        }
+        if err := tx.Commit(); err != nil {
+            return err
+        }
+    }
+
+    return nil
 }
 
+const userColumns = "id, username, password_hash, is_admin, role, disabled, oidc_subject, totp_secret, totp_enabled, totp_required, failed_logins, locked_until, created_at"
+
+// CreateUser saves a new user. Users without a role are viewers, or admins
+// when IsAdmin is set.
 func (s *Store) CreateUser(user *models.User, password string) error {
     hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
     if err != nil {
         return err
     }
 
+    if user.Role == "" {
+        user.Role = models.RoleViewer
+        if user.IsAdmin {
+            user.Role = models.RoleAdmin
+        }
+    }
+    user.IsAdmin = user.Role == models.RoleAdmin
     user.PasswordHash = string(hash)
     user.CreatedAt = time.Now()
 
     _, err = s.db.Exec(
-        "INSERT INTO users (id, username, password_hash, is_admin, created_at) VALUES (?, ?, ?, ?, ?)",
-        user.ID, user.Username, user.PasswordHash, user.IsAdmin, user.CreatedAt,
+        "INSERT INTO users ("+userColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+        user.ID, user.Username, user.PasswordHash, user.IsAdmin, user.Role, user.Disabled, user.OIDCSubject,
+        user.TOTPSecret, user.TOTPEnabled, user.TOTPRequired, user.FailedLogins, user.LockedUntil, user.CreatedAt,
     )
+    if err != nil && strings.Contains(err.Error(), "UNIQUE") {
+        return ErrExists
+    }
     return err
 }
 
-func (s *Store) GetUser(username string) (*models.User, error) {
+func scanUser(row scanner) (*models.User, error) {
     var user models.User
-    err := s.db.QueryRow(
-        "SELECT id, username, password_hash, is_admin, created_at FROM users WHERE username = ?",
-        username,
-    ).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.IsAdmin, &user.CreatedAt)
-
+    var lockedUntil sql.NullTime
+    err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.IsAdmin, &user.Role, &user.Disabled,
+        &user.OIDCSubject, &user.TOTPSecret, &user.TOTPEnabled, &user.TOTPRequired,
+        &user.FailedLogins, &lockedUntil, &user.CreatedAt)
     if err == sql.ErrNoRows {
         return nil, ErrNotFound
     }
+    if lockedUntil.Valid {
+        user.LockedUntil = &lockedUntil.Time
+    }
     return &user, err
 }
 
+func (s *Store) GetUser(username string) (*models.User, error) {
+    return scanUser(s.db.QueryRow(
+        "SELECT "+userColumns+" FROM users WHERE username = ?",
+        username,
+    ))
+}
+
+func (s *Store) GetUserByID(id string) (*models.User, error) {
+    return scanUser(s.db.QueryRow(
+        "SELECT "+userColumns+" FROM users WHERE id = ?",
+        id,
+    ))
+}
+
+// GetUserBySubject finds the user provisioned for an OpenID Connect subject.
+func (s *Store) GetUserBySubject(subject string) (*models.User, error) {
+    return scanUser(s.db.QueryRow(
+        "SELECT "+userColumns+" FROM users WHERE oidc_subject = ?",
+        subject,
+    ))
+}
+
+// ValidateUser checks a password login. Locked out users are refused with
+// ErrLocked before their password is checked.
 func (s *Store) ValidateUser(username, password string) (*models.User, error) {
     user, err := s.GetUser(username)
     if err != nil {
         return nil, err
     }
 
+    if user.Locked(time.Now()) {
+        return nil, ErrLocked
+    }
+
     if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-        return nil, errors.New("invalid password")
+        return nil, ErrInvalidPassword
+    }
+
+    if user.Disabled {
+        return nil, ErrDisabled
     }
 
     return user, nil
 }
 
+func (s *Store) ListUsers() ([]*models.User, error) {
+    rows, err := s.db.Query("SELECT " + userColumns + " FROM users ORDER BY username")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var users []*models.User
+    for rows.Next() {
+        user, err := scanUser(rows)
+        if err != nil {
+            return nil, err
+        }
+        users = append(users, user)
+    }
+
+    return users, rows.Err()
+}
+
+// UpdateUser saves a user's role, disabled flag and whether they must use
+// two-factor authentication. It fails with
+// ErrLastAdmin rather than demote or disable the last enabled admin.
+func (s *Store) UpdateUser(user *models.User) error {
+    user.IsAdmin = user.Role == models.RoleAdmin
+
+    return s.guardAdmins(func(tx *sql.Tx) error {
+        result, err := tx.Exec(
+            "UPDATE users SET role = ?, is_admin = ?, disabled = ?, totp_required = ? WHERE id = ?",
+            user.Role, user.IsAdmin, user.Disabled, user.TOTPRequired, user.ID,
+        )
+        if err != nil {
+            return err
+        }
+
+        if n, _ := result.RowsAffected(); n == 0 {
+            return ErrNotFound
+        }
+        return nil
+    })
+}
+
+// DeleteUser removes a user with their grants, API tokens and sessions. It
+// fails with ErrLastAdmin rather than delete the last enabled admin.
+func (s *Store) DeleteUser(id string) error {
+    return s.guardAdmins(func(tx *sql.Tx) error {
+        if _, err := tx.Exec("DELETE FROM grants WHERE user_id = ?", id); err != nil {
+            return err
+        }
+        if _, err := tx.Exec("DELETE FROM api_tokens WHERE user_id = ?", id); err != nil {
+            return err
+        }
+        if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", id); err != nil {
+            return err
+        }
+        if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", id); err != nil {
+            return err
+        }
+
+        result, err := tx.Exec("DELETE FROM users WHERE id = ?", id)
+        if err != nil {
+            return err
+        }
+
+        if n, _ := result.RowsAffected(); n == 0 {
+            return ErrNotFound
+        }
+        return nil
+    })
+}
+
+// guardAdmins runs change in a transaction and rolls it back if it leaves no
+// enabled admin.
+func (s *Store) guardAdmins(change func(tx *sql.Tx) error) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if err := change(tx); err != nil {
+        return err
+    }
+
+    var admins int
+    if err := tx.QueryRow(
+        "SELECT COUNT(*) FROM users WHERE role = ? AND NOT disabled",
+        models.RoleAdmin,
+    ).Scan(&admins); err != nil {
+        return err
+    }
+    if admins == 0 {
+        return ErrLastAdmin
+    }
+
+    return tx.Commit()
+}
+
+func (s *Store) SetPassword(userID, password string) error {
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    if err != nil {
+        return err
+    }
+
+    result, err := s.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", string(hash), userID)
+    if err != nil {
+        return err
+    }
+
+    if n, _ := result.RowsAffected(); n == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+// CheckPassword reports whether password is the user's current password.
+func (s *Store) CheckPassword(userID, password string) (bool, error) {
+    user, err := s.GetUserByID(userID)
+    if err != nil {
+        return false, err
+    }
+    return bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil, nil
+}
+
+const deviceColumns = "id, name, address, created_at, created_by, use_global, credentials_id, domains, resolver, generate_ptr, client_sync, device_group, tls_verify, tls_ca, tls_fingerprint"
+
 func (s *Store) CreateDevice(device *models.UnifiDevice) error {
     device.CreatedAt = time.Now()
+    if device.TLSVerify == "" {
+        device.TLSVerify = models.TLSVerifyPin
+    }
 
-    _, err := s.db.Exec(
-        "INSERT INTO unifi_devices (id, name, address, created_at, created_by, use_global, credentials_id) VALUES (?, ?, ?, ?, ?, ?, ?)",
+    clientSync, err := encodeClientSync(device.ClientSync)
+    if err != nil {
+        return err
+    }
+
+    _, err = s.db.Exec(
+        "INSERT INTO unifi_devices ("+deviceColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
         device.ID, device.Name, device.Address, device.CreatedAt, device.CreatedBy, device.UseGlobal,
-        device.Credentials.ID,
+        device.Credentials.ID, joinList(device.Domains), device.Resolver, device.GeneratePTR,
+        clientSync, device.Group, device.TLSVerify, device.TLSCA, device.TLSFingerprint,
     )
     return err
 }
 
-func (s *Store) GetDevice(id string) (*models.UnifiDevice, error) {
+// UpdateDevice saves the editable settings of a device. Credentials and the
+// pinned certificate are managed separately.
+func (s *Store) UpdateDevice(device *models.UnifiDevice) error {
+    clientSync, err := encodeClientSync(device.ClientSync)
+    if err != nil {
+        return err
+    }
+
+    result, err := s.db.Exec(
+        "UPDATE unifi_devices SET name = ?, address = ?, domains = ?, resolver = ?, generate_ptr = ?, client_sync = ?, device_group = ?, tls_verify = ?, tls_ca = ? WHERE id = ?",
+        device.Name, device.Address, joinList(device.Domains), device.Resolver, device.GeneratePTR,
+        clientSync, device.Group, device.TLSVerify, device.TLSCA, device.ID,
+    )
+    if err != nil {
+        return err
+    }
+
+    if n, _ := result.RowsAffected(); n == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+// SetDeviceFingerprint pins the controller certificate with the given
+// fingerprint, or clears the pin when it is empty.
+func (s *Store) SetDeviceFingerprint(id, fingerprint string) error {
+    result, err := s.db.Exec("UPDATE unifi_devices SET tls_fingerprint = ? WHERE id = ?", fingerprint, id)
+    if err != nil {
+        return err
+    }
+
+    if n, _ := result.RowsAffected(); n == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+// scanDevice reads a device row, returning the ID of its credentials, if
+// any, for loadCredentials.
+func scanDevice(row scanner) (*models.UnifiDevice, sql.NullString, error) {
     var device models.UnifiDevice
     var credsID sql.NullString
+    var domains, clientSync string
 
-    err := s.db.QueryRow(
-        "SELECT id, name, address, created_at, created_by, use_global, credentials_id FROM unifi_devices WHERE id = ?",
+    if err := row.Scan(&device.ID, &device.Name, &device.Address, &device.CreatedAt, &device.CreatedBy,
+        &device.UseGlobal, &credsID, &domains, &device.Resolver, &device.GeneratePTR, &clientSync, &device.Group,
+        &device.TLSVerify, &device.TLSCA, &device.TLSFingerprint); err != nil {
+        return nil, credsID, err
+    }
+
+    device.Domains = splitList(domains)
+
+    if clientSync != "" {
+        device.ClientSync = &models.ClientSyncSettings{}
+        if err := json.Unmarshal([]byte(clientSync), device.ClientSync); err != nil {
+            return nil, credsID, fmt.Errorf("device %s: client sync settings: %w", device.ID, err)
+        }
+    }
+
+    return &device, credsID, nil
+}
+
+func (s *Store) loadCredentials(device *models.UnifiDevice, credsID sql.NullString) error {
+    if !credsID.Valid {
+        return nil
+    }
+    creds, err := s.GetCredentials(credsID.String)
+    if err != nil {
+        return err
+    }
+    device.Credentials = creds
+    return nil
+}
+
+func (s *Store) GetDevice(id string) (*models.UnifiDevice, error) {
+    device, credsID, err := scanDevice(s.db.QueryRow(
+        "SELECT "+deviceColumns+" FROM unifi_devices WHERE id = ?",
         id,
-    ).Scan(&device.ID, &device.Name, &device.Address, &device.CreatedAt, &device.CreatedBy,
-        &device.UseGlobal, &credsID)
+    ))
 
     if err == sql.ErrNoRows {
         return nil, ErrNotFound
@@ -164,21 +568,15 @@ func (s *Store) GetDevice(id string) (*models.UnifiDevice, error) {
     if err != nil {
         return nil, err
     }
-
-    if credsID.Valid {
-        creds, err := s.GetCredentials(credsID.String)
-        if err != nil {
-            return nil, err
-        }
-        device.Credentials = creds
-    }
-
-    return &device, nil
+    return device, s.loadCredentials(device, credsID)
 }
 
+// ListDevices returns every device. Credentials are loaded once the device
+// rows are closed: querying while they are open takes a second connection,
+// which deadlocks against a writer waiting for the first one to finish.
 func (s *Store) ListDevices() ([]*models.UnifiDevice, error) {
     rows, err := s.db.Query(
-        "SELECT id, name, address, created_at, created_by, use_global, credentials_id FROM unifi_devices",
+        "SELECT " + deviceColumns + " FROM unifi_devices",
     )
     if err != nil {
         return nil, err
@@ -186,27 +584,50 @@ func (s *Store) ListDevices() ([]*models.UnifiDevice, error) {
     defer rows.Close()
 
     var devices []*models.UnifiDevice
+    var credsIDs []sql.NullString
     for rows.Next() {
-        var device models.UnifiDevice
-        var credsID sql.NullString
-        
-        if err := rows.Scan(&device.ID, &device.Name, &device.Address, &device.CreatedAt,
-            &device.CreatedBy, &device.UseGlobal, &credsID); err != nil {
+        device, credsID, err := scanDevice(rows)
+        if err != nil {
             return nil, err
         }
+        devices = append(devices, device)
+        credsIDs = append(credsIDs, credsID)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    rows.Close()
 
-        if credsID.Valid {
-            creds, err := s.GetCredentials(credsID.String)
-            if err != nil {
-                return nil, err
-            }
-            device.Credentials = creds
+    for i, device := range devices {
+        if err := s.loadCredentials(device, credsIDs[i]); err != nil {
+            return nil, err
         }
+    }
+    return devices, nil
+}
 
-        devices = append(devices, &device)
+// Lists such as device domains and token scopes are stored comma separated.
+func joinList(items []string) string {
+    return strings.Join(items, ",")
+}
+
+func splitList(items string) []string {
+    var result []string
+    for _, item := range strings.Split(items, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            result = append(result, item)
+        }
     }
+    return result
+}
 
-    return devices, nil
+// Client sync settings are stored as JSON, or empty when disabled.
+func encodeClientSync(settings *models.ClientSyncSettings) (string, error) {
+    if settings == nil || settings.Domain == "" {
+        return "", nil
+    }
+    data, err := json.Marshal(settings)
+    return string(data), err
 }
 
 func (s *Store) CreateCredentials(creds *models.UnifiCredentials) error {
@@ -281,11 +702,35 @@ func (s *Store) SaveAppConfig(config *models.AppConfig) error {
         globalCredsID.Valid = true
     }
 
-    _, err := s.db.Exec(
-        "INSERT OR REPLACE INTO app_config (is_initialized, global_creds_id) VALUES (?, ?)",
+    // app_config holds a single row.
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.Exec("DELETE FROM app_config"); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(
+        "INSERT INTO app_config (is_initialized, global_creds_id) VALUES (?, ?)",
         config.IsInitialized, globalCredsID,
-    )
-    return err
+    ); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// Ping checks that the database can be reached.
+func (s *Store) Ping(ctx context.Context) error {
+    return s.db.PingContext(ctx)
+}
+
+// SchemaVersion returns the migration the database is at and the latest one
+// this build knows.
+func (s *Store) SchemaVersion(ctx context.Context) (current, latest int, err error) {
+    err = s.db.QueryRowContext(ctx, "SELECT version FROM schema_version LIMIT 1").Scan(&current)
+    return current, len(migrations), err
 }
 
 func (s *Store) Close() error {
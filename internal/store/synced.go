@@ -0,0 +1,60 @@
+package store
+
+import (
+    "time"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+)
+
+// SyncedRecord is a record this service created on a controller. Only
+// records listed here are ever deleted from a controller, so records that
+// were added on the controller by hand are left alone.
+type SyncedRecord struct {
+    DeviceID string
+    RemoteID string
+    Name     string
+    RRType   string
+    Value    string
+    SyncedAt time.Time
+}
+
+func (s *Store) ListSyncedRecords(deviceID string) ([]*SyncedRecord, error) {
+    rows, err := s.db.Query(
+        "SELECT device_id, remote_id, name, rrtype, value, synced_at FROM synced_records WHERE device_id = ?",
+        deviceID,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var records []*SyncedRecord
+    for rows.Next() {
+        var record SyncedRecord
+        if err := rows.Scan(&record.DeviceID, &record.RemoteID, &record.Name, &record.RRType,
+            &record.Value, &record.SyncedAt); err != nil {
+            return nil, err
+        }
+        records = append(records, &record)
+    }
+
+    return records, rows.Err()
+}
+
+// SaveSyncedRecord records that remote, as returned by the controller of
+// deviceID, is managed by this service.
+func (s *Store) SaveSyncedRecord(deviceID string, remote models.DNSRecord) error {
+    _, err := s.db.Exec(
+        "INSERT OR REPLACE INTO synced_records (device_id, remote_id, name, rrtype, value, synced_at) VALUES (?, ?, ?, ?, ?, ?)",
+        deviceID, remote.ID, remote.Name, remote.RRType, remote.Value, time.Now(),
+    )
+    return err
+}
+
+func (s *Store) DeleteSyncedRecord(deviceID, remoteID string) error {
+    _, err := s.db.Exec(
+        "DELETE FROM synced_records WHERE device_id = ? AND remote_id = ?",
+        deviceID, remoteID,
+    )
+    return err
+}
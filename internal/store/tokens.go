@@ -0,0 +1,99 @@
+package store
+
+import (
+    "database/sql"
+    "time"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+)
+
+const tokenColumns = "id, user_id, name, prefix, hash, scopes, expires_at, last_used_at, created_at"
+
+func (s *Store) CreateAPIToken(token *models.APIToken) error {
+    token.CreatedAt = time.Now()
+
+    _, err := s.db.Exec(
+        "INSERT INTO api_tokens ("+tokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+        token.ID, token.UserID, token.Name, token.Prefix, token.Hash, joinList(token.Scopes),
+        token.ExpiresAt, token.LastUsedAt, token.CreatedAt,
+    )
+    return err
+}
+
+func scanAPIToken(row scanner) (*models.APIToken, error) {
+    var token models.APIToken
+    var scopes string
+    var expiresAt, lastUsedAt sql.NullTime
+
+    err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.Prefix, &token.Hash, &scopes,
+        &expiresAt, &lastUsedAt, &token.CreatedAt)
+    if err == sql.ErrNoRows {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    token.Scopes = splitList(scopes)
+    if expiresAt.Valid {
+        token.ExpiresAt = &expiresAt.Time
+    }
+    if lastUsedAt.Valid {
+        token.LastUsedAt = &lastUsedAt.Time
+    }
+    return &token, nil
+}
+
+func (s *Store) GetAPIToken(id string) (*models.APIToken, error) {
+    return scanAPIToken(s.db.QueryRow("SELECT "+tokenColumns+" FROM api_tokens WHERE id = ?", id))
+}
+
+// GetAPITokenByHash looks up a token by the hash of its secret.
+func (s *Store) GetAPITokenByHash(hash string) (*models.APIToken, error) {
+    return scanAPIToken(s.db.QueryRow("SELECT "+tokenColumns+" FROM api_tokens WHERE hash = ?", hash))
+}
+
+// ListAPITokens returns the tokens of a user, or of every user when userID is
+// empty.
+func (s *Store) ListAPITokens(userID string) ([]*models.APIToken, error) {
+    query := "SELECT " + tokenColumns + " FROM api_tokens"
+    var args []interface{}
+    if userID != "" {
+        query += " WHERE user_id = ?"
+        args = append(args, userID)
+    }
+
+    rows, err := s.db.Query(query+" ORDER BY created_at", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var tokens []*models.APIToken
+    for rows.Next() {
+        token, err := scanAPIToken(rows)
+        if err != nil {
+            return nil, err
+        }
+        tokens = append(tokens, token)
+    }
+
+    return tokens, rows.Err()
+}
+
+func (s *Store) TouchAPIToken(id string, usedAt time.Time) error {
+    _, err := s.db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", usedAt, id)
+    return err
+}
+
+func (s *Store) DeleteAPIToken(id string) error {
+    result, err := s.db.Exec("DELETE FROM api_tokens WHERE id = ?", id)
+    if err != nil {
+        return err
+    }
+
+    if n, _ := result.RowsAffected(); n == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
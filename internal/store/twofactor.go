@@ -0,0 +1,90 @@
+package store
+
+// SetTOTP stores a user's TOTP secret and whether it is in use. An empty
+// secret turns two-factor authentication off and removes the recovery codes.
+func (s *Store) SetTOTP(userID, secret string, enabled bool) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    result, err := tx.Exec(
+        "UPDATE users SET totp_secret = ?, totp_enabled = ?, totp_last_step = 0 WHERE id = ?",
+        secret, enabled, userID,
+    )
+    if err != nil {
+        return err
+    }
+    if n, _ := result.RowsAffected(); n == 0 {
+        return ErrNotFound
+    }
+
+    if secret == "" {
+        if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+            return err
+        }
+    }
+
+    return tx.Commit()
+}
+
+// LastTOTPStep returns the time step of the last code the user signed in
+// with.
+func (s *Store) LastTOTPStep(userID string) (int64, error) {
+    var step int64
+    err := s.db.QueryRow("SELECT totp_last_step FROM users WHERE id = ?", userID).Scan(&step)
+    return step, err
+}
+
+// UseTOTPStep records that a code from step was used. It returns false if a
+// code from the same or a later step was already used, so concurrent
+// attempts with one code cannot both succeed.
+func (s *Store) UseTOTPStep(userID string, step int64) (bool, error) {
+    result, err := s.db.Exec(
+        "UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?",
+        step, userID, step,
+    )
+    if err != nil {
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n == 1, err
+}
+
+// ReplaceRecoveryCodes swaps a user's recovery codes for new ones, given as
+// hashes.
+func (s *Store) ReplaceRecoveryCodes(userID string, hashes []string) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+        return err
+    }
+    for _, hash := range hashes {
+        if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hash); err != nil {
+            return err
+        }
+    }
+
+    return tx.Commit()
+}
+
+// UseRecoveryCode consumes a recovery code, reporting whether it was valid.
+func (s *Store) UseRecoveryCode(userID, hash string) (bool, error) {
+    result, err := s.db.Exec("DELETE FROM recovery_codes WHERE user_id = ? AND code_hash = ?", userID, hash)
+    if err != nil {
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n == 1, err
+}
+
+func (s *Store) CountRecoveryCodes(userID string) (int, error) {
+    var n int
+    err := s.db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ?", userID).Scan(&n)
+    return n, err
+}
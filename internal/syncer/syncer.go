@@ -0,0 +1,395 @@
+// Package syncer pushes the enabled records in dns_records to the UniFi
+// controllers they belong to.
+//
+// A record is identified on the controller by its name, type and value, so
+// changing a record's value replaces it. Controller records that this
+// service did not create are never modified or removed, including ones
+// identical to a stored record, which are left in place instead of created
+// again.
+package syncer
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/api"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/logging"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/metrics"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/ptr"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+)
+
+var (
+    lastSync = metrics.NewGauge("unifi_dns_sync_last_success_timestamp_seconds",
+        "Unix time of the last successful sync of each device.", "device")
+    syncFailures = metrics.NewCounter("unifi_dns_sync_failures_total",
+        "Syncs of a device that failed.", "device")
+    syncChanges = metrics.NewCounter("unifi_dns_sync_changes_total",
+        "Controller records created or deleted to correct drift, by device and action.", "device", "action")
+)
+
+// ErrClosed is returned by SyncDevice once Close has been called.
+var ErrClosed = errors.New("syncer is closed")
+
+// Result describes one reconciliation of a device.
+type Result struct {
+    DeviceID string
+    Created  int
+    Deleted  int
+    At       time.Time
+}
+
+type Syncer struct {
+    store   *store.Store
+    trigger chan struct{}
+
+    // mu serialises reconciliations so two passes never race on the same
+    // controller.
+    mu     sync.Mutex
+    closed bool
+
+    // beat is when Run last started or finished a pass, in Unix nanoseconds.
+    beat atomic.Int64
+
+    // ptrConflicts holds the conflicts found when each device's PTR
+    // records were last derived.
+    stateMu      sync.Mutex
+    ptrConflicts map[string][]ptr.Conflict
+}
+
+func New(store *store.Store) *Syncer {
+    return &Syncer{
+        store:        store,
+        trigger:      make(chan struct{}, 1),
+        ptrConflicts: make(map[string][]ptr.Conflict),
+    }
+}
+
+// Run reconciles every device each interval, and whenever Trigger is
+// called, until ctx is cancelled.
+func (s *Syncer) Run(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        s.beat.Store(time.Now().UnixNano())
+        s.SyncAll(logging.NewContext(context.Background(), "sync_id", logging.NewID()))
+        s.beat.Store(time.Now().UnixNano())
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        case <-s.trigger:
+        }
+    }
+}
+
+// Trigger asks Run to start a pass as soon as possible without waiting for
+// it to finish.
+func (s *Syncer) Trigger() {
+    select {
+    case s.trigger <- struct{}{}:
+    default:
+    }
+}
+
+// Heartbeat returns when Run last started or finished a pass, or the zero
+// time if it has not started.
+func (s *Syncer) Heartbeat() time.Time {
+    if n := s.beat.Load(); n != 0 {
+        return time.Unix(0, n)
+    }
+    return time.Time{}
+}
+
+// Close waits for a reconciliation in progress to finish and makes later
+// ones fail with ErrClosed, so shutting down never leaves a controller
+// halfway through a pass.
+func (s *Syncer) Close() {
+    s.mu.Lock()
+    s.closed = true
+    s.mu.Unlock()
+}
+
+// SyncAll reconciles every device, logging failures.
+func (s *Syncer) SyncAll(ctx context.Context) {
+    logger := logging.FromContext(ctx)
+    devices, err := s.store.ListDevices()
+    if err != nil {
+        logger.Error("Sync: failed to list devices", "error", err)
+        return
+    }
+
+    for _, device := range devices {
+        _, err := s.SyncDevice(ctx, device.ID)
+        if errors.Is(err, ErrClosed) {
+            return
+        }
+        if err != nil {
+            logger.Error("Sync: device failed", "device", device.Name, "device_id", device.ID, "error", err)
+        }
+    }
+}
+
+// SyncDevice brings the controller of one device in line with its enabled
+// records. Cancelling ctx does not stop a pass that has started, so the
+// controller is never left halfway; ctx carries the log fields.
+func (s *Syncer) SyncDevice(ctx context.Context, deviceID string) (*Result, error) {
+    ctx = context.WithoutCancel(ctx)
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.closed {
+        return nil, ErrClosed
+    }
+
+    device, err := s.store.GetDevice(deviceID)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := s.derivePTRs(device); err != nil {
+        return nil, fmt.Errorf("derive PTR records: %w", err)
+    }
+
+    result, err := s.reconcile(ctx, device)
+    if err != nil {
+        syncFailures.Inc(device.Name)
+        return nil, err
+    }
+
+    if result.Created > 0 || result.Deleted > 0 {
+        logging.FromContext(ctx).Info("Sync: corrected drift", "device", device.Name, "device_id", device.ID,
+            "created", result.Created, "deleted", result.Deleted)
+    }
+
+    lastSync.Set(float64(result.At.Unix()), device.Name)
+    syncChanges.Add(float64(result.Created), device.Name, "created")
+    syncChanges.Add(float64(result.Deleted), device.Name, "deleted")
+    return result, nil
+}
+
+// reconcile does the work of SyncDevice. The caller holds s.mu.
+func (s *Syncer) reconcile(ctx context.Context, device *models.UnifiDevice) (*Result, error) {
+    deviceID := device.ID
+
+    records, err := s.store.ListDNSRecords(deviceID)
+    if err != nil {
+        return nil, err
+    }
+
+    owned, err := s.store.ListSyncedRecords(deviceID)
+    if err != nil {
+        return nil, err
+    }
+
+    client, err := s.client(ctx, device)
+    if err != nil {
+        return nil, err
+    }
+
+    remote, err := client.GetDNSRecords()
+    if err != nil {
+        return nil, fmt.Errorf("list controller records: %w", err)
+    }
+
+    desired := make(map[string]*models.DNSRecord)
+    for _, record := range records {
+        if record.Enabled {
+            desired[key(record.Name, record.RRType, record.Value)] = record
+        }
+    }
+
+    ownedIDs := make(map[string]bool, len(owned))
+    for _, record := range owned {
+        ownedIDs[record.RemoteID] = true
+    }
+
+    result := &Result{DeviceID: deviceID, At: time.Now()}
+    present := make(map[string]bool)
+
+    for _, record := range remote {
+        k := key(record.Name, record.RRType, record.Value)
+        if _, ok := desired[k]; ok {
+            // Already on the controller. An identical record created by
+            // someone else stays unowned, so removing ours never deletes it.
+            present[k] = true
+            continue
+        }
+
+        if !ownedIDs[record.ID] {
+            continue
+        }
+
+        if err := client.DeleteDNSRecord(record.ID); err != nil {
+            return nil, fmt.Errorf("delete %s %s: %w", record.RRType, record.Name, err)
+        }
+        if err := s.store.DeleteSyncedRecord(deviceID, record.ID); err != nil {
+            return nil, err
+        }
+        result.Deleted++
+    }
+
+    // Forget records that disappeared from the controller by other means.
+    remoteIDs := make(map[string]bool, len(remote))
+    for _, record := range remote {
+        remoteIDs[record.ID] = true
+    }
+    for _, record := range owned {
+        if !remoteIDs[record.RemoteID] {
+            if err := s.store.DeleteSyncedRecord(deviceID, record.RemoteID); err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    for k, record := range desired {
+        if present[k] {
+            continue
+        }
+        create := *record
+        create.ID = ""
+        if err := client.CreateDNSRecord(create); err != nil {
+            return nil, fmt.Errorf("create %s %s: %w", record.RRType, record.Name, err)
+        }
+        result.Created++
+    }
+
+    if result.Created > 0 {
+        // The controller assigns IDs on creation, so read them back to take
+        // ownership of what was just created.
+        remote, err := client.GetDNSRecords()
+        if err != nil {
+            return nil, fmt.Errorf("list controller records: %w", err)
+        }
+        for _, record := range remote {
+            k := key(record.Name, record.RRType, record.Value)
+            if _, ok := desired[k]; ok && !present[k] {
+                if err := s.store.SaveSyncedRecord(deviceID, record); err != nil {
+                    return nil, err
+                }
+            }
+        }
+    }
+
+    return result, nil
+}
+
+// derivePTRs regenerates the device's PTR records so they match the
+// forward records about to be pushed. PTRs are derived per device, so only
+// its own records are read.
+func (s *Syncer) derivePTRs(device *models.UnifiDevice) error {
+    records, err := s.store.ListDNSRecords(device.ID)
+    if err != nil {
+        return err
+    }
+
+    derived, conflicts := ptr.Derive(records, []*models.UnifiDevice{device})
+    if _, _, _, err := s.store.ReconcileSource(models.SourcePTR, device.ID, derived); err != nil {
+        return err
+    }
+
+    s.stateMu.Lock()
+    defer s.stateMu.Unlock()
+    if fmt.Sprint(conflicts) != fmt.Sprint(s.ptrConflicts[device.ID]) {
+        for _, conflict := range conflicts {
+            log.Printf("Sync: PTR conflict: %s", conflict)
+        }
+    }
+    s.ptrConflicts[device.ID] = conflicts
+    return nil
+}
+
+// PTRConflicts returns the conflicts found when PTR records were last
+// derived, ordered by device.
+func (s *Syncer) PTRConflicts() []ptr.Conflict {
+    s.stateMu.Lock()
+    defer s.stateMu.Unlock()
+
+    deviceIDs := make([]string, 0, len(s.ptrConflicts))
+    for deviceID := range s.ptrConflicts {
+        deviceIDs = append(deviceIDs, deviceID)
+    }
+    sort.Strings(deviceIDs)
+
+    conflicts := []ptr.Conflict{}
+    for _, deviceID := range deviceIDs {
+        conflicts = append(conflicts, s.ptrConflicts[deviceID]...)
+    }
+    return conflicts
+}
+
+// WithClient calls fn with a logged in client for the device. It holds the
+// same lock as SyncDevice, so the two never race on the controller session
+// or on pinning its certificate. The client's requests carry ctx.
+func (s *Syncer) WithClient(ctx context.Context, deviceID string, fn func(*api.UnifiClient) error) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.closed {
+        return ErrClosed
+    }
+
+    device, err := s.store.GetDevice(deviceID)
+    if err != nil {
+        return err
+    }
+
+    client, err := s.client(ctx, device)
+    if err != nil {
+        return err
+    }
+    return fn(client)
+}
+
+// client returns a logged in client for the device, resolving the global
+// credentials if the device uses them. The caller holds s.mu.
+func (s *Syncer) client(ctx context.Context, device *models.UnifiDevice) (*api.UnifiClient, error) {
+    if device.UseGlobal {
+        creds, err := s.store.GetGlobalCredentials()
+        if err != nil {
+            return nil, fmt.Errorf("global credentials: %w", err)
+        }
+        device.Credentials = creds
+    }
+
+    if device.Credentials == nil {
+        return nil, errors.New("device has no credentials")
+    }
+
+    client, err := api.NewUnifiClient(ctx, *device)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := client.Login(); err != nil {
+        return nil, err
+    }
+
+    // Trust on first use: pin the certificate the controller presented
+    if device.TLSVerify == models.TLSVerifyPin && device.TLSFingerprint == "" {
+        fingerprint := client.PresentedFingerprint()
+        if err := s.store.SetDeviceFingerprint(device.ID, fingerprint); err != nil {
+            return nil, fmt.Errorf("pin controller certificate: %w", err)
+        }
+        device.TLSFingerprint = fingerprint
+        logging.FromContext(ctx).Info("Sync: pinned controller certificate", "device", device.Name,
+            "device_id", device.ID, "fingerprint", fingerprint)
+    }
+
+    return client, nil
+}
+
+func key(name, rrtype, value string) string {
+    return strings.ToLower(strings.TrimSuffix(name, ".")) + "|" + strings.ToUpper(rrtype) + "|" + value
+}
@@ -0,0 +1,125 @@
+// Package twofactor implements RFC 6238 time-based one-time passwords and
+// single-use recovery codes for local accounts.
+//
+// Codes are six digits over 30 second steps, accepted one step either side
+// of the current one to allow for clock drift. Callers record the step of
+// each accepted code so that a code cannot be used twice.
+package twofactor
+
+import (
+    "bytes"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/base64"
+    "encoding/hex"
+    "image/png"
+    "strings"
+    "time"
+
+    "github.com/pquerna/otp"
+    "github.com/pquerna/otp/totp"
+)
+
+const (
+    // Issuer is shown in authenticator apps next to the account name.
+    Issuer = "Unifi DNS Manager"
+
+    period = 30
+    skew   = 1
+
+    recoveryCodeCount = 10
+)
+
+// Enrollment is a new secret waiting to be confirmed with a first code.
+type Enrollment struct {
+    Secret string `json:"secret"`
+    URL    string `json:"otpauth_url"`
+    // QRCode is a PNG data URL of URL, for scanning into an authenticator.
+    QRCode string `json:"qr_code"`
+}
+
+// Enroll generates a secret for account.
+func Enroll(account string) (*Enrollment, error) {
+    key, err := totp.Generate(totp.GenerateOpts{
+        Issuer:      Issuer,
+        AccountName: account,
+        Period:      period,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    img, err := key.Image(240, 240)
+    if err != nil {
+        return nil, err
+    }
+    var buf bytes.Buffer
+    if err := png.Encode(&buf, img); err != nil {
+        return nil, err
+    }
+
+    return &Enrollment{
+        Secret: key.Secret(),
+        URL:    key.URL(),
+        QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+    }, nil
+}
+
+// Validate checks code against secret at now and returns the time step it
+// belongs to. Codes from steps at or before lastStep are rejected as
+// replays.
+func Validate(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+    code = strings.TrimSpace(code)
+    current := now.Unix() / period
+
+    for step := current - skew; step <= current+skew; step++ {
+        if step <= lastStep {
+            continue
+        }
+        want, err := totp.GenerateCodeCustom(secret, time.Unix(step*period, 0), totp.ValidateOpts{
+            Period:    period,
+            Digits:    otp.DigitsSix,
+            Algorithm: otp.AlgorithmSHA1,
+        })
+        if err != nil {
+            return 0, false
+        }
+        if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+            return step, true
+        }
+    }
+    return 0, false
+}
+
+// RecoveryCodes returns a fresh set of recovery codes, formatted for display
+// as two groups of five characters.
+func RecoveryCodes() ([]string, error) {
+    codes := make([]string, recoveryCodeCount)
+    for i := range codes {
+        b := make([]byte, 7)
+        if _, err := rand.Read(b); err != nil {
+            return nil, err
+        }
+        code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+        codes[i] = code[:5] + "-" + code[5:]
+    }
+    return codes, nil
+}
+
+// HashRecoveryCode returns the stored form of a recovery code. Codes are
+// matched regardless of case, spaces and dashes.
+func HashRecoveryCode(code string) string {
+    code = strings.ToLower(code)
+    code = strings.NewReplacer("-", "", " ", "").Replace(code)
+    sum := sha256.Sum256([]byte(code))
+    return hex.EncodeToString(sum[:])
+}
+
+// IsRecoveryCode reports whether input looks like a recovery code rather
+// than a one-time password.
+func IsRecoveryCode(input string) bool {
+    input = strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(input))
+    return len(input) == 10
+}
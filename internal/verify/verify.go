@@ -0,0 +1,204 @@
+// Package verify confirms that the gateways actually answer for the records
+// pushed to them, by querying each device's resolver for every enabled
+// record and comparing the answer with the stored value.
+package verify
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net"
+    "strings"
+    "time"
+
+    "github.com/miekg/dns"
+
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/dnsutil"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/metrics"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/models"
+    "github.com/jlengelbrecht/unifi-dns-sync/internal/store"
+)
+
+var verifyRecords = metrics.NewGauge("unifi_dns_verify_records",
+    "Enabled records by device and result of the last resolution check; anything but ok is drift.", "device", "status")
+
+type Verifier struct {
+    store  *store.Store
+    client *dns.Client
+}
+
+func New(store *store.Store, timeout time.Duration) *Verifier {
+    return &Verifier{
+        store:  store,
+        client: &dns.Client{Timeout: timeout},
+    }
+}
+
+// Run verifies every device at once and then each interval until ctx is
+// cancelled.
+func (v *Verifier) Run(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        v.verifyAll(ctx)
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// verifyAll checks every device, logging failures, until ctx is cancelled.
+func (v *Verifier) verifyAll(ctx context.Context) {
+    devices, err := v.store.ListDevices()
+    if err != nil {
+        log.Printf("Verify: failed to list devices: %v", err)
+        return
+    }
+    for _, device := range devices {
+        if _, err := v.VerifyDevice(ctx, device.ID); err != nil {
+            if ctx.Err() != nil {
+                return
+            }
+            log.Printf("Verify: device %s: %v", device.Name, err)
+        }
+    }
+}
+
+// VerifyDevice checks every enabled record of a device and stores the
+// results, which it also returns. It stops with ctx's error once ctx is
+// cancelled, without storing the check in progress.
+func (v *Verifier) VerifyDevice(ctx context.Context, deviceID string) ([]*models.RecordCheck, error) {
+    device, err := v.store.GetDevice(deviceID)
+    if err != nil {
+        return nil, err
+    }
+
+    records, err := v.store.ListDNSRecords(deviceID)
+    if err != nil {
+        return nil, err
+    }
+
+    resolver := device.ResolverAddress()
+    var checks []*models.RecordCheck
+    failed := 0
+
+    for _, record := range records {
+        if !record.Enabled {
+            continue
+        }
+
+        check := v.check(ctx, resolver, record)
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        if err := v.store.SaveRecordCheck(check); err != nil {
+            return nil, err
+        }
+        if check.Status != models.CheckOK && check.Status != models.CheckSkipped {
+            failed++
+        }
+        checks = append(checks, check)
+    }
+
+    counts := make(map[string]int)
+    for _, check := range checks {
+        counts[check.Status]++
+    }
+    for _, status := range []string{models.CheckOK, models.CheckMissing, models.CheckMismatch, models.CheckError, models.CheckSkipped} {
+        verifyRecords.Set(float64(counts[status]), device.Name, status)
+    }
+
+    if failed > 0 {
+        log.Printf("Verify: device %s: %d of %d records do not resolve as expected via %s",
+            device.Name, failed, len(checks), resolver)
+    }
+    return checks, nil
+}
+
+func (v *Verifier) check(ctx context.Context, resolver string, record *models.DNSRecord) *models.RecordCheck {
+    check := &models.RecordCheck{
+        RecordID:  record.ID,
+        CheckedAt: time.Now(),
+    }
+
+    qtype, ok := dns.StringToType[record.RRType]
+    if !ok || strings.Contains(record.Name, "*") {
+        check.Status = models.CheckSkipped
+        check.Detail = "wildcard and unknown record types are not verified"
+        return check
+    }
+
+    m := new(dns.Msg)
+    m.SetQuestion(dns.Fqdn(record.Name), qtype)
+    m.RecursionDesired = true
+
+    resp, err := v.exchange(ctx, m, resolver)
+    if err != nil {
+        check.Status = models.CheckError
+        check.Detail = err.Error()
+        return check
+    }
+
+    if resp.Rcode != dns.RcodeSuccess {
+        check.Status = models.CheckMissing
+        check.Detail = dns.RcodeToString[resp.Rcode]
+        return check
+    }
+
+    var got []string
+    for _, rr := range resp.Answer {
+        if rr.Header().Rrtype != qtype || !strings.EqualFold(rr.Header().Name, dns.Fqdn(record.Name)) {
+            continue
+        }
+        value, ok := dnsutil.Value(rr)
+        if !ok {
+            continue
+        }
+        if sameValue(record.RRType, value, record.Value) {
+            check.Status = models.CheckOK
+            return check
+        }
+        got = append(got, value)
+    }
+
+    if len(got) == 0 {
+        check.Status = models.CheckMissing
+        check.Detail = "no " + record.RRType + " answer"
+        return check
+    }
+
+    check.Status = models.CheckMismatch
+    check.Detail = fmt.Sprintf("resolver answered %s", strings.Join(got, ", "))
+    return check
+}
+
+func sameValue(rrtype, got, want string) bool {
+    switch rrtype {
+    case "TXT":
+        return got == want
+    case "A", "AAAA":
+        return net.ParseIP(got).Equal(net.ParseIP(want))
+    }
+    return strings.EqualFold(strings.TrimSuffix(got, "."), strings.TrimSuffix(want, "."))
+}
+
+// exchange sends m to resolver. The dns package only applies ctx's
+// deadline, so the connection is also closed once ctx is cancelled, which
+// ends a wait for a resolver that does not answer.
+func (v *Verifier) exchange(ctx context.Context, m *dns.Msg, resolver string) (*dns.Msg, error) {
+    conn, err := v.client.DialContext(ctx, resolver)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    stop := context.AfterFunc(ctx, func() { conn.Close() })
+    defer stop()
+
+    resp, _, err := v.client.ExchangeWithConnContext(ctx, m, conn)
+    return resp, err
+}